@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// ALLOC: Pick free addresses in a subnet, or a free address block for a new subnet, from what VSD holds (see "ipam.go").
+// The results are kept in the result buffer, for use by later commands -- e.g. "$_.IPAddress", "$_.address".
+// Nothing is reserved on VSD.
+
+// ALLOC ip <SubnetID> [ <count> ]
+func allocip(args []string) (string, error) {
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return "Format: ALLOC ip <SubnetID> [ <count> ]", nil
+		}
+		count = n
+	}
+
+	sn := vspk.NewSubnet()
+	sn.ID = args[0]
+	if err := sn.Fetch(); err != nil {
+		return "", err
+	}
+
+	v, err := fetchsubnetipam(cmdctx, sn)
+	if err != nil {
+		return "", err
+	}
+	if v.block == nil {
+		return "Subnet [" + sn.Name + "] has no IPv4 address / netmask", nil
+	}
+
+	ips := v.nextfree(count)
+	if len(ips) < count {
+		return fmt.Sprintf("Subnet [%s] %s has only %d free address(es) outside its address ranges", sn.Name, v.block, len(ips)), nil
+	}
+
+	allocated := make([]map[string]interface{}, len(ips))
+	for i, ip := range ips {
+		fmt.Println(ip)
+		allocated[i] = map[string]interface{}{
+			"IPAddress": ip.String(),
+			"netmask":   net.IP(v.block.Mask).String(),
+			"gateway":   sn.Gateway,
+			"subnetID":  sn.ID,
+		}
+	}
+	keep(allocated)
+
+	return "ALLOC ip -- done", nil
+}
+
+// Address blocks of the subnets of a domain
+func domainblocks(d *vspk.Domain) ([]*net.IPNet, error) {
+	sl, err := d.Subnets(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*net.IPNet
+	for _, sn := range sl {
+		ip, mask := net.ParseIP(sn.Address).To4(), net.ParseIP(sn.Netmask).To4()
+		if ip != nil && mask != nil {
+			blocks = append(blocks, &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)})
+		}
+	}
+	return blocks, nil
+}
+
+// First block of the given prefix length within "within" that overlaps none of "taken"
+func freeblock(within *net.IPNet, prefix int, taken []*net.IPNet) *net.IPNet {
+	size := uint64(1) << uint(32-prefix)
+	first, last := blockrange(within)
+
+	for n := uint64(first); n+size-1 <= uint64(last); {
+		next := uint64(0)
+		for _, b := range taken {
+			bfirst, blast := blockrange(b)
+			if uint64(bfirst) <= n+size-1 && uint64(blast) >= n {
+				// Skip past the overlapping block, keeping the alignment
+				if end := (uint64(blast) + size) / size * size; end > next {
+					next = end
+				}
+			}
+		}
+
+		if next == 0 {
+			return &net.IPNet{IP: ipfrom(uint32(n)), Mask: net.CIDRMask(prefix, 32)}
+		}
+		n = next
+	}
+	return nil
+}
+
+// ALLOC subnet <ZoneID | DomainID> /<prefix> [ --within <CIDR> ]
+func allocsubnet(args []string) (string, error) {
+	const format = "Format: ALLOC subnet <ZoneID | DomainID> /<prefix length> [ --within <CIDR> ]"
+
+	if len(args) != 2 && !(len(args) == 4 && args[2] == "--within") {
+		return format, nil
+	}
+
+	prefix, err := strconv.Atoi(strings.TrimPrefix(args[1], "/"))
+	if err != nil || prefix < 8 || prefix > 30 {
+		return format, nil
+	}
+
+	within := &net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}
+	if len(args) == 4 {
+		_, block, perr := net.ParseCIDR(args[3])
+		if perr != nil || block.IP.To4() == nil {
+			return format, nil
+		}
+		within = &net.IPNet{IP: block.IP.To4(), Mask: block.Mask[len(block.Mask)-4:]}
+		if ones, _ := within.Mask.Size(); ones > prefix {
+			return fmt.Sprintf("Cannot allocate a /%d within %s", prefix, within), nil
+		}
+	}
+
+	// Subnets must not overlap within the domain: For a zone, check the subnets of its domain
+	d := vspk.NewDomain()
+	zone := vspk.NewZone()
+	zone.ID = args[0]
+	switch zerr := zone.Fetch(); {
+	case zerr == nil:
+		d.ID = zone.ParentID
+	case notfound(zerr):
+		d.ID = args[0]
+	default:
+		return "", zerr
+	}
+	if derr := d.Fetch(); derr != nil {
+		return "", derr
+	}
+
+	taken, err := domainblocks(d)
+	if err != nil {
+		return "", err
+	}
+
+	block := freeblock(within, prefix, taken)
+	if block == nil {
+		return fmt.Sprintf("No free /%d left within %s in domain [%s]", prefix, within, d.Name), nil
+	}
+
+	first, _ := blockrange(block)
+	fmt.Println(block)
+	keep(map[string]interface{}{
+		"address":  block.IP.String(),
+		"netmask":  net.IP(block.Mask).String(),
+		"gateway":  ipfrom(first + 1).String(),
+		"CIDR":     block.String(),
+		"domainID": d.ID,
+	})
+
+	return "ALLOC subnet -- done", nil
+}
+
+// ALLOC ip <SubnetID> [ <count> ] | ALLOC subnet <ZoneID | DomainID> /<prefix> [ --within <CIDR> ]
+func Alloc(args ...string) (string, error) {
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	switch {
+	case len(args) >= 2 && args[0] == "ip" && len(args) <= 3:
+		return allocip(args[1:])
+	case len(args) >= 3 && args[0] == "subnet":
+		return allocsubnet(args[1:])
+	}
+	return "Format: ALLOC ip <SubnetID> [ <count> ] | ALLOC subnet <ZoneID | DomainID> /<prefix length> [ --within <CIDR> ]", nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFreeBlock(t *testing.T) {
+	tests := []struct {
+		within string
+		prefix int
+		taken  []string
+		want   string
+	}{
+		{"10.0.0.0/16", 24, nil, "10.0.0.0/24"},
+		{"10.0.0.0/16", 24, []string{"10.0.0.0/24"}, "10.0.1.0/24"},
+		{"10.0.0.0/16", 24, []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.3.0/24"}, "10.0.2.0/24"},
+		// Alignment kept past smaller and larger blocks
+		{"10.0.0.0/16", 24, []string{"10.0.0.128/25"}, "10.0.1.0/24"},
+		{"10.0.0.0/16", 26, []string{"10.0.0.0/23"}, "10.0.2.0/26"},
+		{"10.0.0.0/16", 26, []string{"10.0.0.64/27"}, "10.0.0.0/26"},
+		// Blocks outside "within" do not matter
+		{"10.0.0.0/16", 24, []string{"192.168.0.0/24", "10.1.0.0/24"}, "10.0.0.0/24"},
+		// Block covering "within"
+		{"10.0.0.0/16", 24, []string{"10.0.0.0/8"}, ""},
+		// Full
+		{"10.0.0.0/23", 24, []string{"10.0.0.0/24", "10.0.1.0/24"}, ""},
+		{"10.0.0.0/24", 23, nil, ""},
+		// Top of the address space
+		{"255.255.255.0/24", 25, []string{"255.255.255.0/25"}, "255.255.255.128/25"},
+		{"255.255.255.0/24", 25, []string{"255.255.255.0/25", "255.255.255.128/25"}, ""},
+	}
+
+	for _, tt := range tests {
+		_, within, _ := net.ParseCIDR(tt.within)
+		var taken []*net.IPNet
+		for _, b := range tt.taken {
+			_, block, _ := net.ParseCIDR(b)
+			taken = append(taken, block)
+		}
+
+		got := ""
+		if block := freeblock(within, tt.prefix, taken); block != nil {
+			got = block.String()
+		}
+		if got != tt.want {
+			t.Errorf("freeblock(%s, /%d, %v) = %q, want %q", tt.within, tt.prefix, tt.taken, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Audit log of mutating operations (CREATE / UPDATE / DELETE / APPLY). One JSON record per line, appended to "auditfname".
+// Shell commands record their operations themselves, updates are recorded by the transport ("auditing").
+
+const auditdefault = ".nuage-vsd-shell_audit.log"
+
+var auditfname = defaultauditpath()
+
+type auditrecord struct {
+	Timestamp    time.Time       `json:"timestamp"`
+	LocalUser    string          `json:"localUser"`
+	URL          string          `json:"vsdURL"`
+	User         string          `json:"vsdUser"`
+	Organization string          `json:"vsdOrganization"`
+	Command      string          `json:"command"`
+	Entity       string          `json:"entity"`
+	ID           string          `json:"ID"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	Error        string          `json:"error,omitempty"`
+
+	f *os.File
+}
+
+func defaultauditpath() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, auditdefault)
+}
+
+func localuser() string {
+	if u, err := osuser.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Start an audit record for a mutating operation. The audit file is opened upfront: If it cannot be written
+// to, the operation must not go ahead.
+func newaudit(command string, args []string, entity, id string) (*auditrecord, error) {
+	rec := &auditrecord{
+		Timestamp: time.Now().UTC(),
+		LocalUser: localuser(),
+		Command:   command + " " + strings.Join(args, " "),
+		Entity:    entity,
+		ID:        id,
+	}
+
+	if mysession != nil {
+		rec.URL = connurl
+		rec.User = mysession.Username
+		rec.Organization = mysession.Organization
+	}
+
+	if auditfname == "" {
+		return rec, nil
+	}
+
+	f, err := os.OpenFile(auditfname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot write to audit file [%s] -- refusing to %s: %s", auditfname, command, err)
+	}
+	rec.f = f
+
+	return rec, nil
+}
+
+// Record the object state before the operation
+func (rec *auditrecord) before(obj interface{}) {
+	rec.Before, _ = json.Marshal(obj)
+}
+
+// Record the object state after the operation
+func (rec *auditrecord) after(obj interface{}) {
+	rec.After, _ = json.Marshal(obj)
+}
+
+// Append the record to the audit file, together with the outcome of the operation
+func (rec *auditrecord) done(err error) {
+	if err != nil {
+		rec.Error = err.Error()
+	}
+
+	if rec.f == nil {
+		return
+	}
+	defer rec.f.Close()
+
+	line, _ := json.Marshal(rec)
+	if _, werr := rec.f.Write(append(line, '\n')); werr != nil {
+		fmt.Printf("Warning: Cannot write to audit file [%s]: %s\n", auditfname, werr)
+	}
+}
+
+// Audit the API calls that update objects -- PUT <entities>/<ID>, made e.g. by policy application: The shell has no
+// UPDATE command of its own. The object is fetched first, for its state before the update. As for the other mutating
+// operations, the update is refused if the audit file cannot be written to.
+func auditing(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		var parts []string
+		if i := strings.Index(req.URL.Path, apiprefix+apiversion+"/"); i >= 0 {
+			parts = strings.Split(strings.Trim(req.URL.Path[i+len(apiprefix+apiversion):], "/"), "/")
+		}
+		if req.Method != "PUT" || len(parts) != 2 {
+			return next.RoundTrip(req)
+		}
+
+		entity, id := singular(parts[0]), parts[1]
+		rec, err := newaudit("UPDATE", []string{entity, id}, entity, id)
+		if err != nil {
+			return nil, err
+		}
+
+		if get, gerr := http.NewRequest("GET", req.URL.String(), nil); gerr == nil {
+			get = get.WithContext(req.Context())
+			get.Header = req.Header.Clone()
+			if resp, gerr := next.RoundTrip(get); gerr == nil {
+				var objs []json.RawMessage
+				if resp.StatusCode == http.StatusOK && json.Unmarshal(readbody(&resp.Body, maxrecordbody), &objs) == nil && len(objs) > 0 {
+					rec.Before = objs[0]
+				}
+				resp.Body.Close()
+			}
+		}
+		if req.GetBody != nil {
+			if body, berr := req.GetBody(); berr == nil {
+				if data := readbody(&body, maxrecordbody); json.Valid(data) {
+					rec.After = data
+				}
+			}
+		}
+
+		resp, err := next.RoundTrip(req)
+		switch {
+		case err != nil:
+			rec.done(err)
+		case resp.StatusCode >= 300:
+			rec.done(fmt.Errorf("HTTP %s", resp.Status))
+		default:
+			rec.done(nil)
+		}
+		return resp, err
+	})
+}
+
+// Set / display the audit file. The audit log cannot be turned off: A change of audit file is recorded in both the old
+// and the new one.
+func audit(args ...string) (string, error) {
+	switch {
+	case len(args) == 0:
+		if auditfname == "" {
+			return "Audit log is off: No home directory", nil
+		}
+		return "Audit log: " + auditfname, nil
+	case len(args) == 2 && args[0] == "file":
+		if args[1] == "" {
+			return "Format: audit [ file <path> ]", nil
+		}
+
+		old, err := newaudit("audit", args, "auditfile", "")
+		if err != nil {
+			return "", err
+		}
+		old.before(map[string]string{"file": auditfname})
+		old.after(map[string]string{"file": args[1]})
+
+		prev := auditfname
+		auditfname = args[1]
+		rec, err := newaudit("audit", args, "auditfile", "")
+		if err != nil {
+			auditfname = prev
+			old.done(err)
+			return "", err
+		}
+		rec.Before, rec.After = old.Before, old.After
+		rec.done(nil)
+		old.done(nil)
+
+		return "Audit log: " + auditfname, nil
+	}
+	return "Format: audit [ file <path> ]", nil
+}
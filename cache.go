@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abiosoft/ishell"
+)
+
+// Object cache: Successful GETs of Nuage API objects and child lists are kept for a while ("cache ttl") and served from
+// memory, keyed by their path -- i.e. entity type, ID and child entity type -- filter and page. Objects updated (PUT) are
+// dropped from the cache, creating or deleting objects drops the whole cache. "--fresh" bypasses the cache for one
+// command.
+//
+// The cache can be saved to / loaded from a file, e.g. to work offline from a snapshot.
+
+type cacheentry struct {
+	Key     string      `json:"key"`
+	Path    string      `json:"path"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    string      `json:"body"`
+	Expires time.Time   `json:"expires"`
+}
+
+// Saved cache
+type cachefile struct {
+	VSDURL     string        `json:"vsdURL"`
+	APIVersion string        `json:"apiVersion"`
+	Saved      time.Time     `json:"saved"`
+	Entries    []*cacheentry `json:"entries"`
+}
+
+var (
+	cachelock sync.Mutex
+	cache     = make(map[string]*cacheentry)
+
+	// How long objects are cached. 0: Caching is off
+	cachettl time.Duration
+
+	// Bypass the cache for the command running
+	cachefresh bool
+
+	cachehits, cachemisses, cacheinvalidations int
+)
+
+// Path segments of an API call, relative to the API prefix: e.g. ["domains", "<ID>", "zones"]
+func cachepath(u *url.URL) []string {
+	i := strings.Index(u.Path, apiprefix)
+	if i < 0 {
+		return nil
+	}
+
+	parts := strings.SplitN(strings.Trim(u.Path[i+len(apiprefix):], "/"), "/", 2)
+	if len(parts) < 2 {
+		return nil
+	}
+	return strings.Split(parts[1], "/")
+}
+
+func clearcache() {
+	cachelock.Lock()
+	defer cachelock.Unlock()
+
+	cache = make(map[string]*cacheentry)
+}
+
+// Drop the entries affected by a change made by API call "method" to "path"
+func invalidate(method string, path []string) {
+	cachelock.Lock()
+	defer cachelock.Unlock()
+
+	// Deleting an object deletes its subtree, and creating one may create others -- e.g. the VM interfaces of a VM, listed
+	// under their vports and subnets: Either may be cached under any path
+	if method == "DELETE" || method == "POST" {
+		cacheinvalidations += len(cache)
+		cache = make(map[string]*cacheentry)
+		return
+	}
+
+	// Updated: Lists of objects of the same type, and the object itself
+	var entity, id string
+	switch len(path) {
+	case 1, 3:
+		entity = path[len(path)-1]
+	case 2:
+		entity, id = path[0], path[1]
+	}
+
+	for key, e := range cache {
+		segments := strings.Split(e.Path, "/")
+		last := segments[len(segments)-1]
+
+		if last == entity || (id != "" && strings.Contains("/"+e.Path+"/", "/"+id+"/")) {
+			delete(cache, key)
+			cacheinvalidations++
+		}
+	}
+}
+
+// Serve GETs from the cache while it is on, and invalidate it on changes
+func caching(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		path := cachepath(req.URL)
+
+		// Only objects are cached, not the login ("me")
+		if path == nil || path[0] == "me" {
+			return next.RoundTrip(req)
+		}
+
+		if req.Method != "GET" {
+			resp, err := next.RoundTrip(req)
+			if err == nil && resp.StatusCode < 400 {
+				invalidate(req.Method, path)
+			}
+			return resp, err
+		}
+
+		if cachettl == 0 {
+			return next.RoundTrip(req)
+		}
+
+		key := cassettekey(req.Method, req.URL.String(), req.Header)
+
+		cachelock.Lock()
+		e, ok := cache[key]
+		if ok && !cachefresh && time.Now().Before(e.Expires) {
+			cachehits++
+			cachelock.Unlock()
+			return newresponse(req, http.StatusOK, e.Header, []byte(e.Body)), nil
+		}
+		cachemisses++
+		cachelock.Unlock()
+
+		resp, err := next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return resp, err
+		}
+
+		// Oversized bodies are not cached
+		body, complete := peekbody(&resp.Body, maxrecordbody)
+		if !complete {
+			return resp, err
+		}
+
+		e = &cacheentry{
+			Key:     key,
+			Path:    strings.Join(path, "/"),
+			Header:  scrubheaders(resp.Header),
+			Body:    string(body),
+			Expires: time.Now().Add(cachettl),
+		}
+
+		cachelock.Lock()
+		cache[key] = e
+		cachelock.Unlock()
+
+		return resp, err
+	})
+}
+
+// Strip a "--fresh" option from command arguments
+func freshoption(args []string) ([]string, bool) {
+	for i, arg := range args {
+		if arg == "--fresh" {
+			return append(args[:i:i], args[i+1:]...), true
+		}
+	}
+	return args, false
+}
+
+// Wraps a shell command so that "--fresh" makes it bypass the cache
+func withfresh(fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		args, fresh := freshoption(args)
+		if !fresh || cachefresh {
+			return fn(args...)
+		}
+
+		cachefresh = true
+		defer func() { cachefresh = false }()
+
+		return fn(args...)
+	}
+}
+
+func savecache(fname string) (string, error) {
+	cachelock.Lock()
+	defer cachelock.Unlock()
+
+	saved := cachefile{
+		VSDURL:     vsdurl,
+		APIVersion: apiversion,
+		Saved:      time.Now(),
+	}
+	// Secrets are not written to disk
+	for _, e := range cache {
+		scrubbed := *e
+		scrubbed.Body = redactbody([]byte(e.Body))
+		saved.Entries = append(saved.Entries, &scrubbed)
+	}
+
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(fname, data, 0600); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d cached entries saved to %s", len(saved.Entries), fname), nil
+}
+
+// Read a saved cache
+func readcachefile(fname string) (*cachefile, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := new(cachefile)
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return saved, nil
+}
+
+// Load a saved cache. Entries that have expired since are dropped
+func loadcache(fname string) (string, error) {
+	saved, err := readcachefile(fname)
+	if err != nil {
+		return "", err
+	}
+
+	if saved.VSDURL != vsdurl || saved.APIVersion != apiversion {
+		return fmt.Sprintf("%s was saved for VSD %s, Nuage API %s -- not loaded", fname, saved.VSDURL, saved.APIVersion), nil
+	}
+
+	cachelock.Lock()
+	defer cachelock.Unlock()
+
+	n := 0
+	for _, e := range saved.Entries {
+		if time.Now().Before(e.Expires) {
+			cache[e.Key] = e
+			n++
+		}
+	}
+	msg := fmt.Sprintf("%d cached entries loaded from %s, %d expired", n, fname, len(saved.Entries)-n)
+	if cachettl == 0 {
+		msg += ". The cache is off -- turn it on with \"cache ttl <duration>\""
+	}
+	return msg, nil
+}
+
+func cachestats() string {
+	cachelock.Lock()
+	defer cachelock.Unlock()
+
+	ttl := "off"
+	if cachettl != 0 {
+		ttl = cachettl.String()
+	}
+
+	expired := 0
+	for _, e := range cache {
+		if time.Now().After(e.Expires) {
+			expired++
+		}
+	}
+
+	return fmt.Sprintf("Cache TTL: %s. Entries: %d (%d expired). Hits: %d, misses: %d, invalidations: %d",
+		ttl, len(cache), expired, cachehits, cachemisses, cacheinvalidations)
+}
+
+// cache stats | clear | ttl <duration> | off | save <file> | load <file>
+func setcache(args ...string) (string, error) {
+	const format = "Format: cache [ stats | clear | ttl <duration> | off | save <file> | load <file> ]"
+
+	switch {
+	case len(args) == 0 || (len(args) == 1 && args[0] == "stats"):
+		return cachestats(), nil
+	case len(args) == 1 && args[0] == "clear":
+		clearcache()
+		return "Cache cleared", nil
+	case len(args) == 1 && args[0] == "off":
+		cachettl = 0
+		clearcache()
+		return "Cache off", nil
+	case len(args) == 2 && args[0] == "ttl":
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return format, nil
+		}
+		cachettl = d
+		return cachestats(), nil
+	case len(args) == 2 && args[0] == "save":
+		return savecache(args[1])
+	case len(args) == 2 && args[0] == "load":
+		return loadcache(args[1])
+	}
+	return format, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCachePath(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://vsd:8443/nuage/api/v5_0/enterprises", "enterprises"},
+		{"https://vsd:8443/nuage/api/v5_0/domains/d1/zones?responseChoice=1", "domains/d1/zones"},
+		{"https://vsd:8443/nuage/api/v5_0/me", "me"},
+		{"https://vsd:8443/nuage/api/v5_0", ""},
+		{"https://vsd:8443/other/path", ""},
+	}
+
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		got := ""
+		for i, s := range cachepath(u) {
+			if i > 0 {
+				got += "/"
+			}
+			got += s
+		}
+		if got != tt.want {
+			t.Errorf("cachepath(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	saved := cache
+	defer func() { cache = saved }()
+
+	paths := []string{
+		"enterprises",
+		"enterprises/e1",
+		"enterprises/e1/domains",
+		"enterprises/e1/vms",
+		"domains/d1",
+		"domains/d1/zones",
+		"zones/z1",
+		"zones/z1/subnets",
+		"subnets/s1/vminterfaces",
+		"vports/p1/vminterfaces",
+		"vms",
+	}
+
+	tests := []struct {
+		method string
+		path   []string
+		kept   []string
+	}{
+		// Updated object: The object, objects under it and lists of objects of its type are dropped
+		{"PUT", []string{"zones", "z1"}, []string{"enterprises", "enterprises/e1", "enterprises/e1/domains",
+			"enterprises/e1/vms", "domains/d1", "subnets/s1/vminterfaces", "vports/p1/vminterfaces", "vms"}},
+		{"PUT", []string{"enterprises", "e1"}, []string{"domains/d1", "domains/d1/zones", "zones/z1", "zones/z1/subnets",
+			"subnets/s1/vminterfaces", "vports/p1/vminterfaces", "vms"}},
+		// Created / deleted objects: Everything is dropped
+		{"POST", []string{"enterprises", "e1", "vms"}, nil},
+		{"POST", []string{"domains"}, nil},
+		{"DELETE", []string{"zones", "z1"}, nil},
+	}
+
+	for _, tt := range tests {
+		cache = make(map[string]*cacheentry)
+		for _, p := range paths {
+			cache["GET "+p] = &cacheentry{Key: "GET " + p, Path: p, Expires: time.Now().Add(time.Hour)}
+		}
+
+		invalidate(tt.method, tt.path)
+
+		var kept []string
+		for _, e := range cache {
+			kept = append(kept, e.Path)
+		}
+		sort.Strings(kept)
+		sort.Strings(tt.kept)
+
+		if len(kept) != len(tt.kept) {
+			t.Errorf("invalidate(%s, %v): kept %v, want %v", tt.method, tt.path, kept, tt.kept)
+			continue
+		}
+		for i := range kept {
+			if kept[i] != tt.kept[i] {
+				t.Errorf("invalidate(%s, %v): kept %v, want %v", tt.method, tt.path, kept, tt.kept)
+				break
+			}
+		}
+	}
+}
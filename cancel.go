@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/abiosoft/ishell"
+)
+
+// Cancellation: Each shell command runs under a context cancelled by Ctrl-C, which aborts the API calls in flight and
+// returns to the prompt -- keeping the connection. API calls can also be given a timeout.
+
+var (
+	// Context of the command running. Set while holding "sessionlock"
+	cmdctx = context.Background()
+
+	// Timeout of API calls, retries included. 0: None
+	apitimeout time.Duration
+
+	errinterrupted = errors.New("Interrupted")
+)
+
+// Context cancelled by Ctrl-C. Call the returned function when done
+func interruptible() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigint := make(chan os.Signal, 1)
+	signal.Notify(sigint, os.Interrupt)
+
+	go func() {
+		select {
+		case <-sigint:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigint)
+		cancel()
+	}
+}
+
+// Wraps a shell command so that it runs under a context cancelled by Ctrl-C
+func withcontext(fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		// Commands run from aliases / "foreach" loops share the context of the outermost command
+		if depth > 0 {
+			return fn(args...)
+		}
+
+		ctx, done := interruptible()
+		cmdctx = ctx
+		defer func() {
+			done()
+			cmdctx = context.Background()
+		}()
+
+		out, err := fn(args...)
+		if ctx.Err() != nil {
+			return out, errinterrupted
+		}
+		return out, err
+	}
+}
+
+// Response body that releases the context of the API call once closed
+type cancelbody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelbody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// Run API calls under the context of the command running, with the API call timeout if any
+func contextual(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if apitimeout > 0 {
+			ctx, cancel = context.WithTimeout(cmdctx, apitimeout)
+		} else {
+			ctx, cancel = context.WithCancel(cmdctx)
+		}
+
+		resp, err := next.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			cancel()
+			return resp, err
+		}
+
+		resp.Body = &cancelbody{resp.Body, cancel}
+		return resp, err
+	})
+}
+
+// Set / display the API call timeout
+func settimeout(args ...string) (string, error) {
+	switch len(args) {
+	case 0:
+	case 1:
+		if args[0] == "off" {
+			apitimeout = 0
+			break
+		}
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return "Format: timeout [ <duration> | off ] -- e.g. 30s, 2m", nil
+		}
+		apitimeout = d
+	default:
+		return "Format: timeout [ <duration> | off ] -- e.g. 30s, 2m", nil
+	}
+
+	if apitimeout == 0 {
+		return "API calls: No timeout", nil
+	}
+	return "API call timeout: " + apitimeout.String(), nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/howeyc/gopass"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Client certificate handling for "makecertconn". The certificate and private key are either two PEM files
+// ("certfname" and "keyfname" -- the private key optionally encrypted, PKCS#8 or legacy OpenSSL), or a single PKCS#12 bundle ("certfname", with
+// a .p12 or .pfx extension).
+
+// Warn when the client certificate expires sooner than this
+const certexpirywarning = 30 * 24 * time.Hour
+
+// Client certificate of the current connection, if established with "makecertconn"
+var clientcert *x509.Certificate
+
+func ispkcs12(fname string) bool {
+	ext := strings.ToLower(filepath.Ext(fname))
+	return ext == ".p12" || ext == ".pfx"
+}
+
+func askpassphrase(what string) ([]byte, error) {
+	fmt.Printf("\tEnter the passphrase for %s > ", what)
+	pass, err := gopass.GetPasswdMasked()
+	if err != nil && err.Error() != "unexpected newline" {
+		return nil, err
+	}
+	return pass, nil
+}
+
+// Encrypted PKCS#8 private keys ("ENCRYPTED PRIVATE KEY"), as written by OpenSSL 1.1 and later: PBES2 with PBKDF2, and
+// AES or 3DES in CBC mode
+var (
+	oidpbes2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidpbkdf2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	pbkdf2prfs = map[string]func() hash.Hash{
+		"1.2.840.113549.2.7":  sha1.New,
+		"1.2.840.113549.2.8":  sha256.New224,
+		"1.2.840.113549.2.9":  sha256.New,
+		"1.2.840.113549.2.10": sha512.New384,
+		"1.2.840.113549.2.11": sha512.New,
+	}
+
+	// Cipher and key length
+	pbes2ciphers = map[string]struct {
+		block  func([]byte) (cipher.Block, error)
+		keylen int
+	}{
+		"2.16.840.1.101.3.4.1.2":  {aes.NewCipher, 16},
+		"2.16.840.1.101.3.4.1.22": {aes.NewCipher, 24},
+		"2.16.840.1.101.3.4.1.42": {aes.NewCipher, 32},
+		"1.2.840.113549.3.7":      {des.NewTripleDESCipher, 24},
+	}
+)
+
+type pkcs8encrypted struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Data      []byte
+}
+
+type pbes2params struct {
+	KDF    pkix.AlgorithmIdentifier
+	Cipher pkix.AlgorithmIdentifier
+}
+
+type pbkdf2params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Decrypt an encrypted PKCS#8 private key into an unencrypted one (DER)
+func decryptpkcs8(der, pass []byte) ([]byte, error) {
+	var key pkcs8encrypted
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return nil, err
+	}
+	if !key.Algorithm.Algorithm.Equal(oidpbes2) {
+		return nil, fmt.Errorf("Unsupported PKCS#8 encryption [%s]: Only PBES2 is supported", key.Algorithm.Algorithm)
+	}
+
+	var params pbes2params
+	if _, err := asn1.Unmarshal(key.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KDF.Algorithm.Equal(oidpbkdf2) {
+		return nil, fmt.Errorf("Unsupported PBES2 key derivation function [%s]: Only PBKDF2 is supported", params.KDF.Algorithm)
+	}
+
+	var kdf pbkdf2params
+	if _, err := asn1.Unmarshal(params.KDF.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	prf := sha1.New
+	if kdf.PRF.Algorithm != nil {
+		if prf = pbkdf2prfs[kdf.PRF.Algorithm.String()]; prf == nil {
+			return nil, fmt.Errorf("Unsupported PBKDF2 pseudo-random function [%s]", kdf.PRF.Algorithm)
+		}
+	}
+
+	c, ok := pbes2ciphers[params.Cipher.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported PBES2 cipher [%s]", params.Cipher.Algorithm)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.Cipher.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	block, err := c.block(pbkdf2.Key(pass, kdf.Salt, kdf.Iterations, c.keylen, prf))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(key.Data) == 0 || len(key.Data)%block.BlockSize() != 0 {
+		return nil, errors.New("Malformed encrypted PKCS#8 private key")
+	}
+
+	plain := make([]byte, len(key.Data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, key.Data)
+
+	// PKCS#7 padding: A wrong passphrase shows as invalid padding, or an invalid key
+	n := int(plain[len(plain)-1])
+	if n == 0 || n > block.BlockSize() {
+		return nil, errors.New("Wrong passphrase")
+	}
+	for _, b := range plain[len(plain)-n:] {
+		if int(b) != n {
+			return nil, errors.New("Wrong passphrase")
+		}
+	}
+	plain = plain[:len(plain)-n]
+
+	if _, err := x509.ParsePKCS8PrivateKey(plain); err != nil {
+		return nil, errors.New("Wrong passphrase")
+	}
+	return plain, nil
+}
+
+// Load the client certificate and private key, asking for the passphrase if needed
+func loadcert() (*tls.Certificate, error) {
+	var (
+		certpem, keypem []byte
+		err             error
+	)
+
+	if ispkcs12(certfname) {
+		p12, err := ioutil.ReadFile(certfname)
+		if err != nil {
+			return nil, err
+		}
+
+		pass, err := askpassphrase("PKCS#12 bundle [" + certfname + "]")
+		if err != nil {
+			return nil, err
+		}
+
+		blocks, err := pkcs12.ToPEM(p12, string(pass))
+		if err != nil {
+			return nil, fmt.Errorf("Cannot decode PKCS#12 bundle [%s]: %s", certfname, err)
+		}
+
+		for _, b := range blocks {
+			if b.Type == "CERTIFICATE" {
+				certpem = append(certpem, pem.EncodeToMemory(b)...)
+			} else {
+				keypem = append(keypem, pem.EncodeToMemory(b)...)
+			}
+		}
+	} else {
+		if certpem, err = ioutil.ReadFile(certfname); err != nil {
+			return nil, err
+		}
+		if keypem, err = ioutil.ReadFile(keyfname); err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(keypem)
+		if block == nil {
+			return nil, fmt.Errorf("No PEM private key found in [%s]", keyfname)
+		}
+
+		switch {
+		case block.Type == "ENCRYPTED PRIVATE KEY":
+			pass, err := askpassphrase("private key [" + keyfname + "]")
+			if err != nil {
+				return nil, err
+			}
+
+			der, err := decryptpkcs8(block.Bytes, pass)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot decrypt private key [%s]: %s", keyfname, err)
+			}
+			keypem = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		case x509.IsEncryptedPEMBlock(block):
+			// Legacy OpenSSL encryption (RFC 1423): "Proc-Type: 4,ENCRYPTED" headers
+			pass, err := askpassphrase("private key [" + keyfname + "]")
+			if err != nil {
+				return nil, err
+			}
+
+			der, err := x509.DecryptPEMBlock(block, pass)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot decrypt private key [%s]: %s", keyfname, err)
+			}
+			keypem = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certpem, keypem)
+	if err != nil {
+		return nil, err
+	}
+
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Client certificate details, for "displayconn"
+func certsummary(cert *x509.Certificate) string {
+	s := fmt.Sprintf("    Certificate subject: [%s]\n    Certificate issuer: [%s]\n    Certificate expires: [%s]\n", cert.Subject, cert.Issuer, cert.NotAfter.Format(time.RFC3339))
+
+	switch left := cert.NotAfter.Sub(time.Now()); {
+	case left <= 0:
+		s += "    WARNING: Certificate has EXPIRED\n"
+	case left < certexpirywarning:
+		s += fmt.Sprintf("    WARNING: Certificate expires in %d day(s)\n", int(left.Hours()/24))
+	}
+	return s
+}
+
+func checkfile(fname string) error {
+	if fname == "" {
+		return errors.New("No file name given")
+	}
+	if _, err := os.Stat(fname); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Set the client certificate and private key files for "makecertconn":
+//
+//	setcertconn <certificate file> [ <private key file> ]
+//
+// or interactively, without arguments. For a PKCS#12 bundle (.p12 / .pfx) no private key file is needed.
+func setcertconn(args ...string) (string, error) {
+	var err error
+
+	cfname, kfname := certfname, keyfname
+
+	switch len(args) {
+	case 0:
+		fmt.Println("Set Nuage API certificate details: Certificate file ; Private key file (Press Enter to keep the current value)")
+
+		fmt.Printf("\tEnter your certificate file -- PEM, or PKCS#12 bundle (.p12 / .pfx) [%s] > ", cfname)
+		if _, err = fmt.Scanln(&cfname); err != nil && err.Error() != "unexpected newline" {
+			return "Error: ", err
+		}
+
+		if !ispkcs12(cfname) {
+			fmt.Printf("\tEnter your private key file -- PEM [%s] > ", kfname)
+			if _, err = fmt.Scanln(&kfname); err != nil && err.Error() != "unexpected newline" {
+				return "Error: ", err
+			}
+		}
+	case 1:
+		cfname = args[0]
+	case 2:
+		cfname, kfname = args[0], args[1]
+	default:
+		return "Format: setcertconn [ <certificate file> [ <private key file> ] ]", nil
+	}
+
+	if err = checkfile(cfname); err != nil {
+		return "Invalid certificate file: ", err
+	}
+	if !ispkcs12(cfname) {
+		if err = checkfile(kfname); err != nil {
+			return "Invalid private key file: ", err
+		}
+	}
+
+	certfname, keyfname = cfname, kfname
+	return "", nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// DESCRIBE: A VM, container or vport in its full context -- interfaces, vports, the networks they are attached to up to
+// the enterprise, policy groups, and the ACL entries of the domain that apply to the vports.
+
+var uuidpattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ACL entry, ingress or egress
+type aclentry struct {
+	id, direction, template string
+	active                  bool
+
+	priority                    int
+	action, description         string
+	locationtype, locationid    string
+	networktype, networkid      string
+	protocol                    string
+	sourceport, destinationport string
+	stateful                    bool
+}
+
+// Domains and L2 domains hold the ACL templates
+type aclholder interface {
+	IngressACLTemplates(*bambou.FetchingInfo) (vspk.IngressACLTemplatesList, *bambou.Error)
+	EgressACLTemplates(*bambou.FetchingInfo) (vspk.EgressACLTemplatesList, *bambou.Error)
+}
+
+// Fetch the ACL entries of a domain / L2 domain
+func fetchacls(holder aclholder) ([]*aclentry, error) {
+	var entries []*aclentry
+
+	itl, err := holder.IngressACLTemplates(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range itl {
+		el, err := t.IngressACLEntryTemplates(&bambou.FetchingInfo{})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range el {
+			entries = append(entries, &aclentry{e.ID, "Ingress", t.Name, t.Active, e.Priority, e.Action, e.Description,
+				e.LocationType, e.LocationID, e.NetworkType, e.NetworkID, e.Protocol, e.SourcePort, e.DestinationPort, e.Stateful})
+		}
+	}
+
+	etl, err := holder.EgressACLTemplates(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range etl {
+		el, err := t.EgressACLEntryTemplates(&bambou.FetchingInfo{})
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range el {
+			entries = append(entries, &aclentry{e.ID, "Egress", t.Name, t.Active, e.Priority, e.Action, e.Description,
+				e.LocationType, e.LocationID, e.NetworkType, e.NetworkID, e.Protocol, e.SourcePort, e.DestinationPort, e.Stateful})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].direction != entries[j].direction {
+			return entries[i].direction > entries[j].direction
+		}
+		return entries[i].priority < entries[j].priority
+	})
+	return entries, nil
+}
+
+// Context of a vport: The objects it belongs to, by ID, and their names
+type vportcontext struct {
+	vport  *vspk.VPort
+	ids    map[string]bool
+	names  map[string]string
+	holder aclholder
+}
+
+// Whether an ACL location / network refers to the vport
+func (c *vportcontext) refers(kind, id string) bool {
+	switch kind {
+	case "ANY":
+		return true
+	case "SUBNET", "ZONE", "POLICYGROUP", "L2DOMAIN", "DOMAIN":
+		return c.ids[id]
+	}
+	return false
+}
+
+// Whether an ACL entry applies to traffic from / to the vport: Located at it, or with it as the network. "ENDPOINT_"
+// networks are relative to the location: Its domain -- the one of the ACL, so the vport's -- subnet or zone. The subnet /
+// zone of a location not referring to the vport is not the vport's
+func (c *vportcontext) applies(e *aclentry) bool {
+	if c.refers(e.locationtype, e.locationid) {
+		return true
+	}
+
+	switch e.networktype {
+	case "ANY", "ENDPOINT_SUBNET", "ENDPOINT_ZONE":
+		return false
+	case "ENDPOINT_DOMAIN":
+		return true
+	}
+	return c.refers(e.networktype, e.networkid)
+}
+
+func (c *vportcontext) name(kind, id string) string {
+	if kind == "ANY" || kind == "" {
+		return "ANY"
+	}
+	if id == "" {
+		return kind
+	}
+	if n, ok := c.names[id]; ok {
+		return kind + " " + n
+	}
+	return kind + " [" + id + "]"
+}
+
+// Print the line of a described object, indented
+func describeline(indent int, label, format string, a ...interface{}) {
+	if label != "" {
+		label += ":"
+	}
+	fmt.Printf("%s%-16s %s\n", strings.Repeat("  ", indent), label, fmt.Sprintf(format, a...))
+}
+
+// Describe a vport: The network it is attached to, up to the enterprise, its policy groups and the ACL entries that apply
+func describevport(vp *vspk.VPort, indent int) {
+	c := &vportcontext{vport: vp, ids: make(map[string]bool), names: make(map[string]string)}
+
+	describeline(indent, "VPort", "%s [%s]  Type %s, active %t, address spoofing %s", vp.Name, vp.ID, vp.Type, vp.Active, vp.AddressSpoofing)
+
+	var domainparent string
+
+	switch vp.ParentType {
+	case "l2domain":
+		l2 := vspk.NewL2Domain()
+		l2.ID = vp.ParentID
+		if err := l2.Fetch(); err != nil {
+			describeline(indent, "L2 domain", "[%s] -- cannot fetch: %s", vp.ParentID, err)
+			return
+		}
+		describeline(indent, "L2 domain", "%s [%s]  %s/%s", l2.Name, l2.ID, l2.Address, l2.Netmask)
+		c.ids[l2.ID], c.names[l2.ID] = true, l2.Name
+		c.holder, domainparent = l2, l2.ParentID
+
+	default:
+		sn := vspk.NewSubnet()
+		sn.ID = vp.ParentID
+		if err := sn.Fetch(); err != nil {
+			describeline(indent, "Subnet", "[%s] -- cannot fetch: %s", vp.ParentID, err)
+			return
+		}
+		describeline(indent, "Subnet", "%s [%s]  %s/%s, gateway %s", sn.Name, sn.ID, sn.Address, sn.Netmask, sn.Gateway)
+		c.ids[sn.ID], c.names[sn.ID] = true, sn.Name
+
+		zone := vspk.NewZone()
+		zone.ID = sn.ParentID
+		if err := zone.Fetch(); err != nil {
+			describeline(indent, "Zone", "[%s] -- cannot fetch: %s", sn.ParentID, err)
+			return
+		}
+		describeline(indent, "Zone", "%s [%s]", zone.Name, zone.ID)
+		c.ids[zone.ID], c.names[zone.ID] = true, zone.Name
+
+		d := vspk.NewDomain()
+		d.ID = zone.ParentID
+		if err := d.Fetch(); err != nil {
+			describeline(indent, "Domain", "[%s] -- cannot fetch: %s", zone.ParentID, err)
+			return
+		}
+		describeline(indent, "Domain", "%s [%s]", d.Name, d.ID)
+		c.ids[d.ID], c.names[d.ID] = true, d.Name
+		c.holder, domainparent = d, d.ParentID
+	}
+
+	org := vspk.NewEnterprise()
+	org.ID = domainparent
+	if err := org.Fetch(); err != nil {
+		describeline(indent, "Enterprise", "[%s] -- cannot fetch: %s", domainparent, err)
+	} else {
+		describeline(indent, "Enterprise", "%s [%s]", org.Name, org.ID)
+	}
+
+	pgl, err := vp.PolicyGroups(&bambou.FetchingInfo{})
+	if err != nil {
+		describeline(indent, "Policy groups", "cannot fetch: %s", err)
+	} else {
+		var pgs []string
+		for _, pg := range pgl {
+			pgs = append(pgs, fmt.Sprintf("%s [%s]", pg.Name, pg.ID))
+			c.ids[pg.ID], c.names[pg.ID] = true, pg.Name
+		}
+		if len(pgs) == 0 {
+			pgs = []string{"<none>"}
+		}
+		describeline(indent, "Policy groups", "%s", strings.Join(pgs, ", "))
+	}
+
+	acls, aerr := fetchacls(c.holder)
+	if aerr != nil {
+		describeline(indent, "ACL entries", "cannot fetch: %s", aerr)
+		return
+	}
+
+	// Entries for traffic from / to the vport: Located at it, or with it as the network
+	n := 0
+	for _, e := range acls {
+		if !c.applies(e) {
+			continue
+		}
+		if n == 0 {
+			describeline(indent, "ACL entries", "")
+		}
+		n++
+
+		inactive := ""
+		if !e.active {
+			inactive = "  (template inactive)"
+		}
+		ports := ""
+		if e.sourceport != "" || e.destinationport != "" {
+			ports = fmt.Sprintf(" ports %s -> %s", e.sourceport, e.destinationport)
+		}
+		if e.stateful {
+			ports += ", stateful"
+		}
+		fmt.Printf("%s  %-7s %5d  %-8s %s -> %s  protocol %s%s%s  [%s] %s\n", strings.Repeat("  ", indent), e.direction, e.priority,
+			e.action, c.name(e.locationtype, e.locationid), c.name(e.networktype, e.networkid), e.protocol, ports, inactive, e.template, e.description)
+	}
+	if n == 0 {
+		describeline(indent, "ACL entries", "<none>")
+	}
+}
+
+// Describe the interfaces of a VM / container, each with its vport
+func describeinterfaces(interfaces []interface{}) {
+	if len(interfaces) == 0 {
+		describeline(0, "Interfaces", "<none>")
+		return
+	}
+
+	describeline(0, "Interfaces", "")
+	for _, intf := range interfaces {
+		name, _ := attribute(intf, "name")
+		id, _ := attribute(intf, "ID")
+		mac, _ := attribute(intf, "MAC")
+		ip, _ := attribute(intf, "IPAddress")
+		netmask, _ := attribute(intf, "netmask")
+		gateway, _ := attribute(intf, "gateway")
+		vportid, _ := attribute(intf, "VPortID")
+
+		fmt.Printf("  %s [%s]\n", name, id)
+		describeline(2, "MAC", "%s", mac)
+		describeline(2, "IP address", "%s/%s, gateway %s", ip, netmask, gateway)
+
+		vp := vspk.NewVPort()
+		vp.ID = vportid
+		if err := vp.Fetch(); err != nil {
+			describeline(2, "VPort", "[%s] -- cannot fetch: %s", vportid, err)
+			continue
+		}
+		describevport(vp, 2)
+	}
+}
+
+// Look up a VM, container or vport by ID, UUID or name
+func lookup(entity, key string) (interface{}, error) {
+	var filters []string
+	if uuidpattern.MatchString(key) {
+		obj := newobject(entity, key)
+		if err := obj.Fetch(); err == nil {
+			return obj, nil
+		}
+		if entity != "vport" {
+			filters = append(filters, fmt.Sprintf("UUID == %q", key))
+		}
+	}
+	filters = append(filters, fmt.Sprintf("name == %q", key))
+
+	for _, filter := range filters {
+		var (
+			found []interface{}
+			err   *bambou.Error
+		)
+
+		switch entity {
+		case "vm":
+			var l vspk.VMsList
+			if l, err = root.VMs(&bambou.FetchingInfo{Filter: filter}); err == nil {
+				for _, o := range l {
+					found = append(found, o)
+				}
+			}
+		case "container":
+			var l vspk.ContainersList
+			if l, err = root.Containers(&bambou.FetchingInfo{Filter: filter}); err == nil {
+				for _, o := range l {
+					found = append(found, o)
+				}
+			}
+		case "vport":
+			var l vspk.VPortsList
+			if l, err = root.VPorts(&bambou.FetchingInfo{Filter: filter}); err == nil {
+				for _, o := range l {
+					found = append(found, o)
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			return nil, fmt.Errorf("%d %ss match [%s] -- give the ID", len(found), entity, key)
+		}
+	}
+	return nil, fmt.Errorf("No %s with ID, UUID or name [%s]", entity, key)
+}
+
+// DESCRIBE vm | container | vport <ID | UUID | name>
+func Describe(args ...string) (string, error) {
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	if len(args) != 2 || (args[0] != "vm" && args[0] != "container" && args[0] != "vport") {
+		return "Format: DESCRIBE vm | container | vport <ID | UUID | name>", nil
+	}
+	entity := args[0]
+
+	obj, err := lookup(entity, args[1])
+	if err != nil {
+		return "", err
+	}
+	keep(obj)
+
+	switch o := obj.(type) {
+	case *vspk.VM:
+		describeline(0, "VM", "%s [%s]", o.Name, o.ID)
+		describeline(0, "UUID", "%s", o.UUID)
+		describeline(0, "Status", "%s", o.Status)
+		describeline(0, "Enterprise", "%s [%s]", o.EnterpriseName, o.EnterpriseID)
+		describeline(0, "User", "%s", o.UserName)
+
+		il, err := o.VMInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return "", err
+		}
+		var interfaces []interface{}
+		for _, intf := range il {
+			interfaces = append(interfaces, intf)
+		}
+		describeinterfaces(interfaces)
+
+	case *vspk.Container:
+		describeline(0, "Container", "%s [%s]", o.Name, o.ID)
+		describeline(0, "UUID", "%s", o.UUID)
+		describeline(0, "Status", "%s", o.Status)
+		describeline(0, "Enterprise", "%s [%s]", o.EnterpriseName, o.EnterpriseID)
+		describeline(0, "User", "%s", o.UserName)
+
+		il, err := o.ContainerInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return "", err
+		}
+		var interfaces []interface{}
+		for _, intf := range il {
+			interfaces = append(interfaces, intf)
+		}
+		describeinterfaces(interfaces)
+
+	case *vspk.VPort:
+		describevport(o, 0)
+
+		// What is attached to the vport
+		var attached []string
+		if il, err := o.VMInterfaces(&bambou.FetchingInfo{}); err == nil {
+			for _, intf := range il {
+				attached = append(attached, fmt.Sprintf("VM interface %s [%s]  MAC %s  IP %s  (VM %s)", intf.Name, intf.ID, intf.MAC, intf.IPAddress, intf.ParentID))
+			}
+		}
+		if unsupported("DESCRIBE", "containerinterfaces") == "" {
+			if il, err := o.ContainerInterfaces(&bambou.FetchingInfo{}); err == nil {
+				for _, intf := range il {
+					attached = append(attached, fmt.Sprintf("Container interface %s [%s]  MAC %s  IP %s  (container %s)", intf.Name, intf.ID, intf.MAC, intf.IPAddress, intf.ParentID))
+				}
+			}
+		}
+		if il, err := o.HostInterfaces(&bambou.FetchingInfo{}); err == nil {
+			for _, intf := range il {
+				attached = append(attached, fmt.Sprintf("Host interface %s [%s]  MAC %s  IP %s", intf.Name, intf.ID, intf.MAC, intf.IPAddress))
+			}
+		}
+		if il, err := o.BridgeInterfaces(&bambou.FetchingInfo{}); err == nil {
+			for _, intf := range il {
+				attached = append(attached, fmt.Sprintf("Bridge interface %s [%s]", intf.Name, intf.ID))
+			}
+		}
+
+		if len(attached) == 0 {
+			attached = []string{"<none>"}
+		}
+		describeline(0, "Attached", "%s", attached[0])
+		for _, a := range attached[1:] {
+			describeline(0, "", "%s", a)
+		}
+	}
+
+	return "DESCRIBE " + entity + " -- done", nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestVPortContextApplies(t *testing.T) {
+	c := &vportcontext{
+		ids:   map[string]bool{"sn1": true, "z1": true, "d1": true, "pg1": true},
+		names: map[string]string{"sn1": "web", "z1": "front", "d1": "prod", "pg1": "web-pg"},
+	}
+
+	tests := []struct {
+		name string
+		e    aclentry
+		want bool
+	}{
+		{"location ANY", aclentry{locationtype: "ANY", networktype: "ANY"}, true},
+		{"location the subnet", aclentry{locationtype: "SUBNET", locationid: "sn1", networktype: "ANY"}, true},
+		{"location the zone", aclentry{locationtype: "ZONE", locationid: "z1", networktype: "ANY"}, true},
+		{"location the policy group", aclentry{locationtype: "POLICYGROUP", locationid: "pg1", networktype: "ANY"}, true},
+		{"location another subnet", aclentry{locationtype: "SUBNET", locationid: "sn2", networktype: "ANY"}, false},
+		{"network the subnet", aclentry{locationtype: "SUBNET", locationid: "sn2", networktype: "SUBNET", networkid: "sn1"}, true},
+		{"network the domain", aclentry{locationtype: "SUBNET", locationid: "sn2", networktype: "DOMAIN", networkid: "d1"}, true},
+		{"network another policy group", aclentry{locationtype: "SUBNET", locationid: "sn2", networktype: "POLICYGROUP", networkid: "pg2"}, false},
+		{"network ENDPOINT_DOMAIN", aclentry{locationtype: "SUBNET", locationid: "sn2", networktype: "ENDPOINT_DOMAIN"}, true},
+		{"network ENDPOINT_SUBNET of another subnet", aclentry{locationtype: "SUBNET", locationid: "sn2", networktype: "ENDPOINT_SUBNET"}, false},
+		{"network ENDPOINT_ZONE of the zone", aclentry{locationtype: "ZONE", locationid: "z1", networktype: "ENDPOINT_ZONE"}, true},
+		{"network ENDPOINT_ZONE of another zone", aclentry{locationtype: "ZONE", locationid: "z2", networktype: "ENDPOINT_ZONE"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := c.applies(&tt.e); got != tt.want {
+			t.Errorf("%s: applies = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	// L2 domain
+	c.ids["l2"], c.names["l2"] = true, "flat"
+	if !c.applies(&aclentry{locationtype: "POLICYGROUP", locationid: "pg2", networktype: "L2DOMAIN", networkid: "l2"}) {
+		t.Errorf("network the L2 domain: Does not apply")
+	}
+
+	for _, tt := range []struct{ kind, id, want string }{
+		{"ANY", "", "ANY"},
+		{"ENDPOINT_DOMAIN", "", "ENDPOINT_DOMAIN"},
+		{"SUBNET", "sn1", "SUBNET web"},
+		{"SUBNET", "sn2", "SUBNET [sn2]"},
+	} {
+		if got := c.name(tt.kind, tt.id); got != tt.want {
+			t.Errorf("name(%s, %s) = %q, want %q", tt.kind, tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/abiosoft/ishell"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+)
+
+// Structured reporting of errors returned by the Nuage API. bambou only keeps the first error title / description of
+// a failed call; the details VSD returns -- per-property validation messages, internal error code -- are recovered
+// from the response captured by the transport chain (see "transport.go").
+
+// Output format: "text" (default) or "json". Set globally with "output", or per command with "-o <format>"
+var outputformat = "text"
+
+// Per-property VSD error message
+type propertyerror struct {
+	Property     string `json:"property"`
+	Descriptions []struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	} `json:"descriptions"`
+}
+
+// Error returned by a Nuage API call
+type vsderror struct {
+	Command     string          `json:"command"`
+	Status      int             `json:"status,omitempty"`
+	StatusText  string          `json:"statusText,omitempty"`
+	Code        int             `json:"internalErrorCode,omitempty"`
+	Title       string          `json:"title,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Properties  []propertyerror `json:"errors,omitempty"`
+	Request     string          `json:"request,omitempty"`
+	RequestBody json.RawMessage `json:"requestBody,omitempty"`
+	Response    string          `json:"response,omitempty"`
+}
+
+// Build a vsderror from a bambou error and -- if any -- the failed API call captured while running the command
+func newvsderror(command string, be *bambou.Error, f *failure) *vsderror {
+	e := &vsderror{
+		Command:     command,
+		Status:      be.Code,
+		Title:       be.Message,
+		Description: be.Description,
+	}
+
+	if f == nil {
+		return e
+	}
+
+	e.Status, e.StatusText = f.Status, f.StatusText
+	e.Request = f.Method + " " + f.URL
+	if json.Valid(f.RequestBody) {
+		e.RequestBody = f.RequestBody
+	}
+
+	var body struct {
+		Errors            []propertyerror `json:"errors"`
+		InternalErrorCode int             `json:"internalErrorCode"`
+		Title             string          `json:"title"`
+		Description       string          `json:"description"`
+	}
+
+	if err := json.Unmarshal(f.Body, &body); err != nil {
+		// Not a VSD error -- e.g. an HTML page from a proxy
+		e.Response = strings.TrimSpace(string(f.Body))
+		return e
+	}
+
+	e.Code, e.Properties = body.InternalErrorCode, body.Errors
+	if body.Title != "" {
+		e.Title, e.Description = body.Title, body.Description
+	}
+	return e
+}
+
+func (e *vsderror) Error() string {
+	if outputformat == "json" {
+		data, _ := json.MarshalIndent(e, "", "\t")
+		return string(data)
+	}
+
+	s := fmt.Sprintf("%s failed", e.Command)
+	if e.Status != 0 {
+		s += fmt.Sprintf("\n    HTTP status: %d %s", e.Status, e.StatusText)
+	}
+	if e.Code != 0 {
+		s += fmt.Sprintf("\n    VSD error code: %d", e.Code)
+	}
+	if e.Title != "" || e.Description != "" {
+		s += fmt.Sprintf("\n    %s: %s", e.Title, e.Description)
+	}
+	for _, p := range e.Properties {
+		for _, d := range p.Descriptions {
+			s += fmt.Sprintf("\n    Property [%s]: %s: %s", p.Property, d.Title, d.Description)
+		}
+	}
+	if e.Request != "" {
+		s += "\n    Request: " + e.Request
+	}
+	if len(e.RequestBody) > 0 {
+		s += "\n    Request body: " + string(e.RequestBody)
+	}
+	if e.Response != "" {
+		s += "\n    Response: " + e.Response
+	}
+	return s
+}
+
+// Strip a "-o <format>" option from command arguments. Returns the format, or "" if none was given
+func outputoption(args []string) ([]string, string, error) {
+	for i := 0; i < len(args); i++ {
+		if args[i] != "-o" {
+			continue
+		}
+
+		if i+1 == len(args) || (args[i+1] != "text" && args[i+1] != "json") {
+			return nil, "", fmt.Errorf("Format: -o text | json")
+		}
+		format := args[i+1]
+		return append(args[:i:i], args[i+2:]...), format, nil
+	}
+	return args, "", nil
+}
+
+// Wraps a shell command so that errors returned by Nuage API calls are reported as vsderror, and "-o <format>" is honoured
+func witherrors(name string, fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		args, format, err := outputoption(args)
+		if err != nil {
+			return "", err
+		}
+
+		if format != "" {
+			saved := outputformat
+			outputformat = format
+			defer func() { outputformat = saved }()
+		}
+
+		lastfailure = nil
+
+		out, err := fn(args...)
+
+		be, ok := err.(*bambou.Error)
+		switch {
+		case ok && be == nil:
+			// A nil *bambou.Error returned as error is no error
+			return out, nil
+		case ok:
+			return out, newvsderror(strings.TrimSpace(name+" "+strings.Join(args, " ")), be, lastfailure)
+		}
+		return out, err
+	}
+}
+
+// Set / display the output format
+func setoutput(args ...string) (string, error) {
+	if len(args) == 1 && (args[0] == "text" || args[0] == "json") {
+		outputformat = args[0]
+	} else if len(args) != 0 {
+		return "Format: output [ text | json ]", nil
+	}
+	return "Output format: " + outputformat, nil
+}
+
+// Whether an error returned by a Nuage API call is due to the object not existing
+func notfound(err error) bool {
+	be, ok := err.(*bambou.Error)
+	return ok && be != nil && be.Code == http.StatusNotFound
+}
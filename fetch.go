@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Fetch engine: Commands that fan out across many objects -- e.g. fetching a subtree -- run their API calls on a bounded
+// worker pool ("fanout"). The transport chain bounds the number of API calls in flight and their rate ("throttle"), and
+// retries API calls that failed transiently -- 429 / 5xx responses, connection resets -- with exponential backoff
+// ("retrying"). Fan-outs stop when the command is cancelled (see "cancel.go").
+//
+// vspk-go API calls take no context: The context of a fan-out only decides whether further calls are started. When one
+// call of a fan-out fails, the calls not yet started -- including those of nested fan-outs, given the fan-out context --
+// are not made, but the calls in flight run to completion. Only cancelling the command ("cmdctx", which the transport
+// applies to every API call) aborts those.
+
+var (
+	// Workers per fan-out, and API calls in flight
+	fetchworkers = 8
+
+	// API calls per second. 0: Unlimited
+	fetchrate float64
+
+	// Retries of a failed API call, and the delay before the first one -- doubled for each further retry
+	fetchretries = 3
+	fetchbackoff = 500 * time.Millisecond
+
+	inflight = make(chan struct{}, fetchworkers)
+
+	ratelock sync.Mutex
+	nextcall time.Time
+)
+
+// Run fn(ctx, 0) ... fn(ctx, n-1) on a pool of workers. Stops at the first error -- which is returned -- or when ctx is
+// cancelled: fn is not called any more, calls running are waited for.
+func fanout(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg    sync.WaitGroup
+		once  sync.Once
+		first error
+	)
+
+	workers := fetchworkers
+	if n < workers {
+		workers = n
+	}
+
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						first = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// Run fn(ctx, 0) ... fn(ctx, n-1) on a pool of workers, as fanout, but without stopping at errors: The error of each
+// call is returned by index. Stops when ctx is cancelled -- returning ctx.Err().
+func fanouteach(ctx context.Context, n int, fn func(ctx context.Context, i int) error) ([]error, error) {
+	errs := make([]error, n)
+	err := fanout(ctx, n, func(ctx context.Context, i int) error {
+		errs[i] = fn(ctx, i)
+		return nil
+	})
+	return errs, err
+}
+
+// Delay before the next API call, to stay within the rate limit
+func ratewait() time.Duration {
+	ratelock.Lock()
+	defer ratelock.Unlock()
+
+	if fetchrate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	if nextcall.Before(now) {
+		nextcall = now
+	}
+	wait := nextcall.Sub(now)
+	nextcall = nextcall.Add(time.Duration(float64(time.Second) / fetchrate))
+	return wait
+}
+
+// Sleep, unless ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Bound the number of API calls in flight, and their rate
+func throttle(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		ctx := req.Context()
+
+		sem := inflight
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-sem }()
+
+		if err := sleep(ctx, ratewait()); err != nil {
+			return nil, err
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Whether a failed API call may succeed if retried. Non-idempotent calls are only retried if VSD did not process them
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		if req.Context().Err() != nil || !idempotent(req.Method) {
+			return false
+		}
+
+		var nerr net.Error
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			(errors.As(err, &nerr) && nerr.Timeout())
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return idempotent(req.Method)
+	}
+	return false
+}
+
+// Delay before retry nr. "attempt" (from 0): Exponential backoff with some jitter, or as told by "Retry-After"
+func backoff(attempt int, resp *http.Response) time.Duration {
+	d := fetchbackoff << uint(attempt)
+	d += time.Duration(rand.Int63n(int64(d)/5 + 1))
+
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(secs)*time.Second > d {
+			d = time.Duration(secs) * time.Second
+		}
+	}
+	return d
+}
+
+// Retry API calls that failed transiently
+func retrying(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		for attempt := 0; ; attempt++ {
+			r := req
+			if attempt > 0 && req.Body != nil {
+				if req.GetBody == nil {
+					return nil, errors.New("Cannot retry " + req.Method + " " + req.URL.String())
+				}
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				r = new(http.Request)
+				*r = *req
+				r.Body = body
+			}
+
+			resp, err := next.RoundTrip(r)
+			if attempt >= fetchretries || !retryable(req, resp, err) {
+				return resp, err
+			}
+
+			d := backoff(attempt, resp)
+
+			if resp != nil {
+				io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxerrorbody))
+				resp.Body.Close()
+				log.WithFields(log.Fields{"call": req.Method + " " + req.URL.String(), "status": resp.Status}).Debugf("API call failed, retrying in %s", d)
+			} else {
+				log.WithFields(log.Fields{"call": req.Method + " " + req.URL.String(), "error": err}).Debugf("API call failed, retrying in %s", d)
+			}
+
+			if err := sleep(req.Context(), d); err != nil {
+				return nil, err
+			}
+		}
+	})
+}
+
+// Set / display the fetch engine settings
+func setfetch(args ...string) (string, error) {
+	const format = "Format: fetch [ workers <n> ] [ rate <calls per second> | off ] [ retries <n> ] [ backoff <duration> ]"
+
+	if len(args)%2 != 0 {
+		return format, nil
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+
+		switch args[i] {
+		case "workers":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return format, nil
+			}
+			fetchworkers = n
+			inflight = make(chan struct{}, n)
+		case "rate":
+			if value == "off" {
+				fetchrate = 0
+				break
+			}
+			r, err := strconv.ParseFloat(value, 64)
+			if err != nil || r <= 0 {
+				return format, nil
+			}
+			fetchrate = r
+		case "retries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return format, nil
+			}
+			fetchretries = n
+		case "backoff":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return format, nil
+			}
+			fetchbackoff = d
+		default:
+			return format, nil
+		}
+	}
+
+	rate := "unlimited"
+	if fetchrate > 0 {
+		rate = strconv.FormatFloat(fetchrate, 'g', -1, 64) + " API calls per second"
+	}
+	return "Workers: " + strconv.Itoa(fetchworkers) + ", rate: " + rate + ", retries: " + strconv.Itoa(fetchretries) + ", backoff: " + fetchbackoff.String(), nil
+}
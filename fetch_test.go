@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFanoutEach(t *testing.T) {
+	failed := errors.New("failed")
+
+	errs, err := fanouteach(context.Background(), 20, func(ctx context.Context, i int) error {
+		if i%5 == 0 {
+			return failed
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fanouteach: %s", err)
+	}
+	for i, e := range errs {
+		if (e != nil) != (i%5 == 0) {
+			t.Errorf("fanouteach: Call %d: error %v", i, e)
+		}
+	}
+
+	// Cancelled: Stops, and says so
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := fanouteach(ctx, 20, func(ctx context.Context, i int) error { return nil }); err != context.Canceled {
+		t.Errorf("fanouteach, cancelled: error %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// Inventory of the VSD objects, and FIND across it.
+//
+// The inventory is built either by crawling the VSD -- enterprises, their domains, zones, subnets and vports, their L2
+// domains and vports, their VMs and containers and their interfaces -- on the worker pool, or from a snapshot: A cache
+// saved with "cache save". Objects are kept as their JSON attributes, so both sources are handled alike. A snapshot only
+// holds what was fetched while the cache was on ("cache ttl"), e.g. by a FIND.
+
+// Object types FIND searches
+var searchable = map[string]bool{
+	"subnets":             true,
+	"l2domains":           true,
+	"vports":              true,
+	"vms":                 true,
+	"vminterfaces":        true,
+	"containers":          true,
+	"containerinterfaces": true,
+}
+
+type invobject struct {
+	// REST name of the object type, e.g. "subnets"
+	entity string
+
+	// Attributes, as returned by VSD -- and by lower-case name, as attribute names differ in case across API versions
+	attrs map[string]interface{}
+	lower map[string]interface{}
+}
+
+type inventory struct {
+	sync.Mutex
+
+	objects  map[string]*invobject
+	children map[string][]*invobject
+
+	// Enterprises not crawled in full, by name, and why
+	failed map[string]error
+}
+
+func newinventory() *inventory {
+	return &inventory{
+		objects:  make(map[string]*invobject),
+		children: make(map[string][]*invobject),
+		failed:   make(map[string]error),
+	}
+}
+
+func (o *invobject) str(name string) string {
+	v, ok := o.lower[strings.ToLower(name)]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// Add objects of a type to the inventory: A list of vspk objects, or the JSON encoding of one
+func (inv *inventory) add(entity string, list interface{}) error {
+	data, ok := list.([]byte)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(list); err != nil {
+			return err
+		}
+	}
+
+	var objs []map[string]interface{}
+	if err := json.Unmarshal(data, &objs); err != nil {
+		return err
+	}
+
+	inv.Lock()
+	defer inv.Unlock()
+
+	for _, attrs := range objs {
+		o := &invobject{entity: entity, attrs: attrs, lower: make(map[string]interface{})}
+		for k, v := range attrs {
+			o.lower[strings.ToLower(k)] = v
+		}
+
+		id := o.str("ID")
+		if id == "" {
+			continue
+		}
+		if _, dup := inv.objects[id]; !dup {
+			inv.children[o.str("parentID")] = append(inv.children[o.str("parentID")], o)
+		}
+		inv.objects[id] = o
+	}
+	return nil
+}
+
+// Crawl the VSD into an inventory. If interrupted, the inventory holds what was fetched so far. Enterprises that failed
+// to be crawled are recorded in the inventory, and the others crawled regardless
+func crawl(ctx context.Context) (*inventory, error) {
+	inv := newinventory()
+
+	orgs, err := root.Enterprises(&bambou.FetchingInfo{})
+	if err != nil {
+		return inv, err
+	}
+	inv.add("enterprises", orgs)
+
+	containers := unsupported("FIND", "containers") == ""
+
+	errs, ferr := fanouteach(ctx, len(orgs), func(ctx context.Context, i int) error {
+		return inv.crawlenterprise(ctx, orgs[i], containers)
+	})
+	if ferr != nil {
+		return inv, ferr
+	}
+
+	for i, cerr := range errs {
+		if cerr != nil {
+			inv.failed[orgs[i].Name] = cerr
+		}
+	}
+	return inv, nil
+}
+
+func (inv *inventory) crawlenterprise(ctx context.Context, org *vspk.Enterprise, containers bool) error {
+	dl, err := org.Domains(&bambou.FetchingInfo{})
+	if err != nil {
+		return err
+	}
+	inv.add("domains", dl)
+
+	l2l, err := org.L2Domains(&bambou.FetchingInfo{})
+	if err != nil {
+		return err
+	}
+	inv.add("l2domains", l2l)
+
+	vml, err := org.VMs(&bambou.FetchingInfo{})
+	if err != nil {
+		return err
+	}
+	inv.add("vms", vml)
+
+	var cl vspk.ContainersList
+	if containers {
+		if cl, err = org.Containers(&bambou.FetchingInfo{}); err != nil {
+			return err
+		}
+		inv.add("containers", cl)
+	}
+
+	if ferr := fanout(ctx, len(dl), func(ctx context.Context, i int) error {
+		zl, err := dl[i].Zones(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		inv.add("zones", zl)
+
+		return fanout(ctx, len(zl), func(ctx context.Context, i int) error {
+			sl, err := zl[i].Subnets(&bambou.FetchingInfo{})
+			if err != nil {
+				return err
+			}
+			inv.add("subnets", sl)
+
+			return fanout(ctx, len(sl), func(ctx context.Context, i int) error {
+				vpl, err := sl[i].VPorts(&bambou.FetchingInfo{})
+				if err != nil {
+					return err
+				}
+				return inv.add("vports", vpl)
+			})
+		})
+	}); ferr != nil {
+		return ferr
+	}
+
+	if ferr := fanout(ctx, len(l2l), func(ctx context.Context, i int) error {
+		vpl, err := l2l[i].VPorts(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		return inv.add("vports", vpl)
+	}); ferr != nil {
+		return ferr
+	}
+
+	if ferr := fanout(ctx, len(vml), func(ctx context.Context, i int) error {
+		il, err := vml[i].VMInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		return inv.add("vminterfaces", il)
+	}); ferr != nil {
+		return ferr
+	}
+
+	return fanout(ctx, len(cl), func(ctx context.Context, i int) error {
+		il, err := cl[i].ContainerInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		return inv.add("containerinterfaces", il)
+	})
+}
+
+// Inventory from a snapshot: A saved cache. Lists are found under paths ending with their type, e.g.
+// "zones/<ID>/subnets", single objects under "<type>/<ID>"
+func loadsnapshot(fname string) (*inventory, error) {
+	saved, err := readcachefile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(saved.Entries) == 0 {
+		return nil, fmt.Errorf("%s: Empty snapshot. Objects are only cached while the cache is on: \"cache ttl <duration>\"", fname)
+	}
+
+	inv := newinventory()
+	for _, e := range saved.Entries {
+		segments := strings.Split(e.Path, "/")
+
+		entity := segments[len(segments)-1]
+		if len(segments)%2 == 0 {
+			entity = segments[0]
+		}
+
+		if err := inv.add(entity, []byte(e.Body)); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", fname, e.Path, err)
+		}
+	}
+	return inv, nil
+}
+
+// Path of an object: Enterprise / domain / zone / subnet, or enterprise / L2 domain ... Interfaces are placed in the network they are attached to,
+// VMs and containers in the networks of their interfaces
+func (inv *inventory) path(o *invobject) string {
+	switch o.entity {
+	case "vminterfaces", "containerinterfaces":
+		if network, ok := inv.objects[o.str("attachedNetworkID")]; ok {
+			return inv.path(network)
+		}
+		if vport, ok := inv.objects[o.str("VPortID")]; ok {
+			return inv.path(vport)
+		}
+		return "?"
+
+	case "vms", "containers":
+		var paths []string
+		seen := make(map[string]bool)
+
+		for _, intf := range inv.children[o.str("ID")] {
+			if p := inv.path(intf); !seen[p] {
+				paths = append(paths, p)
+				seen[p] = true
+			}
+		}
+		if len(paths) > 0 {
+			return strings.Join(paths, ", ")
+		}
+		if org, ok := inv.objects[o.str("enterpriseID")]; ok {
+			return org.str("name")
+		}
+		return "?"
+	}
+
+	names := []string{o.str("name")}
+	for p := inv.objects[o.str("parentID")]; p != nil && len(names) < 16; p = inv.objects[p.str("parentID")] {
+		names = append([]string{p.str("name")}, names...)
+	}
+	return strings.Join(names, "/")
+}
+
+// Address block of a subnet
+func subnetblock(o *invobject) *net.IPNet {
+	ip, mask := net.ParseIP(o.str("address")).To4(), net.ParseIP(o.str("netmask")).To4()
+	if ip == nil || mask == nil {
+		return nil
+	}
+	return &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+}
+
+// Match function for FIND ip: The address, or any address in a CIDR block
+func ipmatcher(arg string) (func(net.IP) bool, error) {
+	if _, block, err := net.ParseCIDR(arg); err == nil {
+		return block.Contains, nil
+	}
+
+	ip := net.ParseIP(arg)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address: %s", arg)
+	}
+	return ip.Equal, nil
+}
+
+type findmatch struct {
+	obj     *invobject
+	matched string
+	path    string
+}
+
+// Search the inventory. Matches are sorted by path
+func (inv *inventory) find(what, arg string) ([]findmatch, error) {
+	var (
+		matches []findmatch
+		ipmatch func(net.IP) bool
+	)
+
+	if what == "ip" {
+		var err error
+		if ipmatch, err = ipmatcher(arg); err != nil {
+			return nil, err
+		}
+	}
+	target := net.ParseIP(arg)
+
+	for _, o := range inv.objects {
+		if !searchable[o.entity] {
+			continue
+		}
+
+		matched := ""
+
+		switch what {
+		case "ip":
+			if ip := net.ParseIP(o.str("IPAddress")); ip != nil && ipmatch(ip) {
+				matched = "IP " + ip.String()
+			} else if (o.entity == "subnets" || o.entity == "l2domains") && target != nil {
+				// Subnets and L2 domains the address belongs to
+				if block := subnetblock(o); block != nil && block.Contains(target) {
+					matched = "Subnet " + block.String()
+				}
+			}
+
+		case "mac":
+			mac := strings.ToLower(o.str("MAC"))
+			if ok, _ := path.Match(strings.ToLower(arg), mac); ok && mac != "" {
+				matched = "MAC " + mac
+			}
+
+		case "name":
+			name := o.str("name")
+			if ok, _ := path.Match(strings.ToLower(arg), strings.ToLower(name)); ok && name != "" {
+				matched = "Name " + name
+			}
+		}
+
+		if matched != "" {
+			matches = append(matches, findmatch{o, matched, inv.path(o)})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].path != matches[j].path {
+			return matches[i].path < matches[j].path
+		}
+		return matches[i].obj.entity < matches[j].obj.entity
+	})
+	return matches, nil
+}
+
+// FIND ip <address>|<CIDR> | mac <pattern> | name <pattern> [ --snapshot <file> ]
+func Find(args ...string) (string, error) {
+	const format = "Format: FIND ip <address> | ip <CIDR> | mac <pattern> | name <pattern> [ --snapshot <file> ]"
+
+	var snapshot string
+	if len(args) == 4 && args[2] == "--snapshot" {
+		snapshot, args = args[3], args[:2]
+	}
+
+	if len(args) != 2 || (args[0] != "ip" && args[0] != "mac" && args[0] != "name") {
+		return format, nil
+	}
+
+	var (
+		inv *inventory
+		err error
+	)
+
+	if snapshot != "" {
+		if inv, err = loadsnapshot(snapshot); err != nil {
+			return "", err
+		}
+	} else {
+		if root == nil {
+			return "Not Connected to a VSD server. Connect, or search a snapshot with --snapshot <file>", nil
+		}
+
+		// Keep what was found so far if interrupted
+		inv, err = crawl(cmdctx)
+		if err != nil && cmdctx.Err() == nil {
+			return "", err
+		}
+	}
+
+	for name, cerr := range inv.failed {
+		fmt.Printf("Warning: Enterprise %s not searched in full: %s\n", name, cerr)
+	}
+
+	matches, ferr := inv.find(args[0], args[1])
+	if ferr != nil {
+		return "", ferr
+	}
+
+	found := make([]map[string]interface{}, len(matches))
+	for i, m := range matches {
+		fmt.Printf("%-20s %-30s ID [%s]  %s  [%s]\n", singular(m.obj.entity), m.obj.str("name"), m.obj.str("ID"), m.matched, m.path)
+		found[i] = m.obj.attrs
+	}
+	keep(found)
+
+	if err != nil {
+		return fmt.Sprintf("Interrupted -- %d match(es) among the %d objects fetched so far", len(matches), len(inv.objects)), err
+	}
+	if len(inv.failed) > 0 {
+		return fmt.Sprintf("FIND -- done: %d match(es) among %d objects. %d enterprise(s) not searched in full", len(matches), len(inv.objects), len(inv.failed)), nil
+	}
+	return fmt.Sprintf("FIND -- done: %d match(es) among %d objects", len(matches), len(inv.objects)), nil
+}
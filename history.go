@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Command history file, kept across runs. Ctrl-R does a reverse search through it.
+const historyfname = ".nuage-vsd-shell_history"
+
+var (
+	// Result buffer: Objects returned by the last successful GET, in the order they were printed.
+	results []interface{}
+
+	// References to the result buffer:
+	//   $_                -- ID of the last object returned
+	//   $<N>              -- ID of object nr [N]
+	//   $_.<attribute>    -- any other attribute of the last object, e.g. $_.name
+	//   $<N>.<attribute>  -- any other attribute of object nr [N], e.g. $0.parentID
+	resultref = regexp.MustCompile(`\$(_|[0-9]+)(\.[A-Za-z0-9_]+)?`)
+)
+
+func historypath() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, historyfname)
+}
+
+// Replace the result buffer with "objs" -- either a single object or a list of them
+func keep(objs interface{}) {
+	results = nil
+
+	v := reflect.ValueOf(objs)
+	if v.Kind() != reflect.Slice {
+		results = append(results, objs)
+		return
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		results = append(results, v.Index(i).Interface())
+	}
+}
+
+// Look up an attribute of an object by its JSON name (case insensitive), e.g. "ID", "name" or "parentID"
+func attribute(obj interface{}, name string) (string, error) {
+	var attrs map[string]interface{}
+
+	b, _ := json.Marshal(obj)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&attrs); err != nil {
+		return "", err
+	}
+
+	for k, v := range attrs {
+		if strings.EqualFold(k, name) {
+			if v == nil {
+				return "", nil
+			}
+			return fmt.Sprint(v), nil
+		}
+	}
+	return "", fmt.Errorf("Object has no attribute [%s]", name)
+}
+
+// Expand result buffer references in a command argument
+func expandresults(arg string) (string, error) {
+	var err error
+
+	expanded := resultref.ReplaceAllStringFunc(arg, func(ref string) string {
+		m := resultref.FindStringSubmatch(ref)
+
+		if len(results) == 0 {
+			err = fmt.Errorf("Cannot expand [%s]: Result buffer is empty -- run a GET first", ref)
+			return ref
+		}
+
+		n := len(results) - 1
+		if m[1] != "_" {
+			n, _ = strconv.Atoi(m[1])
+			if n >= len(results) {
+				err = fmt.Errorf("Cannot expand [%s]: Last GET returned only %d object(s)", ref, len(results))
+				return ref
+			}
+		}
+
+		attr := "ID"
+		if m[2] != "" {
+			attr = m[2][1:]
+		}
+
+		val, aerr := attribute(results[n], attr)
+		if aerr != nil {
+			err = fmt.Errorf("Cannot expand [%s]: %s", ref, aerr)
+			return ref
+		}
+		return val
+	})
+
+	return expanded, err
+}
+
+// Display the result buffer
+func showresults(args ...string) (string, error) {
+	if len(results) == 0 {
+		return "Result buffer is empty", nil
+	}
+
+	for i, obj := range results {
+		id, _ := attribute(obj, "ID")
+		name, _ := attribute(obj, "name")
+		fmt.Printf("  $%d\t ID [%s]  Name [%s]\n", i, id, name)
+	}
+	return "", nil
+}
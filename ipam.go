@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// IP address management views: Addresses allocated in a subnet -- to VM / container / host / bridge interfaces, and
+// DHCP reservations -- free ranges, utilisation and conflicts; and a summary of the subnets of a domain, with
+// overlapping address blocks. IPv4 only.
+
+// Object types holding an address in a subnet
+var addressholders = []string{"vminterfaces", "containerinterfaces", "hostinterfaces", "bridgeinterfaces", "ipreservations"}
+
+// An address allocated in a subnet
+type allocation struct {
+	ip  net.IP
+	obj *invobject
+}
+
+// Range of free addresses
+type iprange struct {
+	first, last uint32
+}
+
+type subnetipam struct {
+	subnet  *invobject
+	block   *net.IPNet
+	gateway net.IP
+
+	// Sorted by address
+	allocations []allocation
+	free        []iprange
+
+	// Address ranges (DHCP pools) of the subnet
+	reserved []iprange
+
+	usable, used int
+	conflicts    []string
+}
+
+func ip4(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func ipfrom(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// First and last address of a block
+func blockrange(block *net.IPNet) (uint32, uint32) {
+	first := ip4(block.IP)
+	ones, bits := block.Mask.Size()
+	return first, uint32(uint64(first) + 1<<uint(bits-ones) - 1)
+}
+
+func (r iprange) String() string {
+	if r.first == r.last {
+		return ipfrom(r.first).String()
+	}
+	return fmt.Sprintf("%s - %s (%d)", ipfrom(r.first), ipfrom(r.last), uint64(r.last)-uint64(r.first)+1)
+}
+
+// Fetch a subnet and the objects holding addresses in it into an inventory
+func crawlsubnet(ctx context.Context, sn *vspk.Subnet) (*inventory, error) {
+	inv := newinventory()
+	inv.add("subnets", []*vspk.Subnet{sn})
+
+	containers := unsupported("SHOW", "containerinterfaces") == ""
+
+	fetches := []func() error{
+		func() error {
+			l, err := sn.VMInterfaces(&bambou.FetchingInfo{})
+			if err != nil {
+				return err
+			}
+			return inv.add("vminterfaces", l)
+		},
+		func() error {
+			if !containers {
+				return nil
+			}
+			l, err := sn.ContainerInterfaces(&bambou.FetchingInfo{})
+			if err != nil {
+				return err
+			}
+			return inv.add("containerinterfaces", l)
+		},
+		func() error {
+			l, err := sn.IPReservations(&bambou.FetchingInfo{})
+			if err != nil {
+				return err
+			}
+			return inv.add("ipreservations", l)
+		},
+		func() error {
+			l, err := sn.AddressRanges(&bambou.FetchingInfo{})
+			if err != nil {
+				return err
+			}
+			return inv.add("addressranges", l)
+		},
+		func() error {
+			// Host and bridge interfaces, through the vports of the subnet
+			vpl, err := sn.VPorts(&bambou.FetchingInfo{})
+			if err != nil {
+				return err
+			}
+			inv.add("vports", vpl)
+
+			return fanout(ctx, len(vpl), func(ctx context.Context, i int) error {
+				hl, err := vpl[i].HostInterfaces(&bambou.FetchingInfo{})
+				if err != nil {
+					return err
+				}
+				inv.add("hostinterfaces", hl)
+
+				bl, err := vpl[i].BridgeInterfaces(&bambou.FetchingInfo{})
+				if err != nil {
+					return err
+				}
+				return inv.add("bridgeinterfaces", bl)
+			})
+		},
+	}
+
+	return inv, fanout(ctx, len(fetches), func(ctx context.Context, i int) error {
+		return fetches[i]()
+	})
+}
+
+// Compute the IPAM view of a subnet from its inventory
+func (inv *inventory) subnetipam(subnet *invobject) *subnetipam {
+	v := &subnetipam{
+		subnet:  subnet,
+		block:   subnetblock(subnet),
+		gateway: net.ParseIP(subnet.str("gateway")),
+	}
+
+	for _, entity := range addressholders {
+		for _, o := range inv.objects {
+			if o.entity != entity {
+				continue
+			}
+			if ip := net.ParseIP(o.str("IPAddress")); ip != nil && ip.To4() != nil {
+				v.allocations = append(v.allocations, allocation{ip, o})
+			}
+		}
+	}
+
+	sort.SliceStable(v.allocations, func(i, j int) bool {
+		return ip4(v.allocations[i].ip) < ip4(v.allocations[j].ip)
+	})
+
+	for _, o := range inv.objects {
+		if o.entity != "addressranges" {
+			continue
+		}
+		min, max := net.ParseIP(o.str("minAddress")), net.ParseIP(o.str("maxAddress"))
+		if min.To4() != nil && max.To4() != nil && ip4(min) <= ip4(max) {
+			v.reserved = append(v.reserved, iprange{ip4(min), ip4(max)})
+		}
+	}
+	sort.Slice(v.reserved, func(i, j int) bool { return v.reserved[i].first < v.reserved[j].first })
+
+	if v.block == nil {
+		v.conflicts = append(v.conflicts, "Subnet has no IPv4 address / netmask")
+		return v
+	}
+
+	first, last := blockrange(v.block)
+	if last-first >= 2 {
+		// Network and broadcast addresses
+		first, last = first+1, last-1
+	}
+	v.usable = int(uint64(last) - uint64(first) + 1)
+
+	taken := make(map[uint32][]*invobject)
+	if v.gateway != nil && v.gateway.To4() != nil {
+		if !v.block.Contains(v.gateway) {
+			v.conflicts = append(v.conflicts, fmt.Sprintf("%s: Gateway outside the subnet", v.gateway))
+		} else {
+			taken[ip4(v.gateway)] = nil
+		}
+	}
+
+	for _, a := range v.allocations {
+		n := ip4(a.ip)
+		switch {
+		case !v.block.Contains(a.ip):
+			v.conflicts = append(v.conflicts, fmt.Sprintf("%s: Outside the subnet -- %s", a.ip, describe(a.obj)))
+			continue
+		case n < first || n > last:
+			v.conflicts = append(v.conflicts, fmt.Sprintf("%s: Network / broadcast address -- %s", a.ip, describe(a.obj)))
+		case v.gateway != nil && a.ip.Equal(v.gateway):
+			v.conflicts = append(v.conflicts, fmt.Sprintf("%s: Gateway address -- %s", a.ip, describe(a.obj)))
+		}
+		taken[n] = append(taken[n], a.obj)
+	}
+
+	// Several holders of the same address. A DHCP reservation for the MAC of the interface holding it is no conflict
+	for n, holders := range taken {
+		if len(holders) < 2 {
+			continue
+		}
+
+		macs := make(map[string]bool)
+		var descs []string
+		for _, o := range holders {
+			macs[strings.ToLower(o.str("MAC"))] = true
+			descs = append(descs, describe(o))
+		}
+		if len(macs) > 1 || len(holders) > 2 {
+			sort.Strings(descs)
+			v.conflicts = append(v.conflicts, fmt.Sprintf("%s: Duplicate -- %s", ipfrom(n), strings.Join(descs, ", ")))
+		}
+	}
+	sort.Strings(v.conflicts)
+
+	// Free ranges: The gaps between the taken addresses
+	var used []uint32
+	for n := range taken {
+		if n >= first && n <= last {
+			used = append(used, n)
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+	v.used = len(used)
+
+	next := uint64(first)
+	for _, n := range used {
+		if uint64(n) > next {
+			v.free = append(v.free, iprange{uint32(next), n - 1})
+		}
+		next = uint64(n) + 1
+	}
+	if next <= uint64(last) {
+		v.free = append(v.free, iprange{uint32(next), last})
+	}
+	return v
+}
+
+// The first "count" free addresses outside the address ranges
+func (v *subnetipam) nextfree(count int) []net.IP {
+	var ips []net.IP
+
+	for _, r := range v.free {
+		for n := uint64(r.first); n <= uint64(r.last) && len(ips) < count; {
+			// Skip past address ranges
+			skip := n
+			for _, rr := range v.reserved {
+				if n >= uint64(rr.first) && n <= uint64(rr.last) && uint64(rr.last)+1 > skip {
+					skip = uint64(rr.last) + 1
+				}
+			}
+			if skip > n {
+				n = skip
+				continue
+			}
+			ips = append(ips, ipfrom(uint32(n)))
+			n++
+		}
+	}
+	return ips
+}
+
+// Short description of an object, e.g. "vminterface eth0 [<ID>]"
+func describe(o *invobject) string {
+	s := singular(o.entity)
+	if name := o.str("name"); name != "" {
+		s += " " + name
+	}
+	return s + " [" + o.str("ID") + "]"
+}
+
+func (v *subnetipam) utilisation() float64 {
+	if v.usable == 0 {
+		return 0
+	}
+	return 100 * float64(v.used) / float64(v.usable)
+}
+
+func (v *subnetipam) print() {
+	fmt.Printf("\n ######## Subnet [%s] ID [%s] ########\n", v.subnet.str("name"), v.subnet.str("ID"))
+	if v.block != nil {
+		fmt.Printf("    Address block: %s  Gateway: %s\n", v.block, v.subnet.str("gateway"))
+		fmt.Printf("    Usable addresses: %d  Allocated: %d (%.1f%%)  Free: %d\n", v.usable, v.used, v.utilisation(), v.usable-v.used)
+	}
+
+	fmt.Printf("\n    %-16s %-20s %-24s %-18s %s\n", "Address", "Type", "Name", "MAC", "ID")
+	if v.gateway != nil {
+		fmt.Printf("    %-16s %-20s\n", v.gateway, "gateway")
+	}
+	for _, a := range v.allocations {
+		fmt.Printf("    %-16s %-20s %-24s %-18s %s\n", a.ip, singular(a.obj.entity), a.obj.str("name"), a.obj.str("MAC"), a.obj.str("ID"))
+	}
+
+	fmt.Println("\n    Free ranges:")
+	for _, r := range v.free {
+		fmt.Printf("    %s\n", r)
+	}
+
+	if len(v.reserved) > 0 {
+		fmt.Println("\n    Address ranges (DHCP pools):")
+		for _, r := range v.reserved {
+			fmt.Printf("    %s\n", r)
+		}
+	}
+
+	if len(v.conflicts) > 0 {
+		fmt.Println("\n    Conflicts:")
+		for _, c := range v.conflicts {
+			fmt.Printf("    %s\n", c)
+		}
+	}
+}
+
+// IPAM view of a subnet, fetched from the VSD
+func fetchsubnetipam(ctx context.Context, sn *vspk.Subnet) (*subnetipam, error) {
+	inv, err := crawlsubnet(ctx, sn)
+	if err != nil {
+		return nil, err
+	}
+	return inv.subnetipam(inv.objects[sn.ID]), nil
+}
+
+// IPAM views of all the subnets of a domain, and the overlaps between their address blocks
+func fetchdomainipam(ctx context.Context, d *vspk.Domain) ([]*subnetipam, []string, error) {
+	sl, err := d.Subnets(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	views := make([]*subnetipam, len(sl))
+	if err := fanout(ctx, len(sl), func(ctx context.Context, i int) error {
+		v, err := fetchsubnetipam(ctx, sl[i])
+		views[i] = v
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].block == nil || views[j].block == nil {
+			return views[j].block == nil && views[i].block != nil
+		}
+		return ip4(views[i].block.IP) < ip4(views[j].block.IP)
+	})
+
+	var overlaps []string
+	for i, a := range views {
+		for _, b := range views[i+1:] {
+			if a.block != nil && b.block != nil && (a.block.Contains(b.block.IP) || b.block.Contains(a.block.IP)) {
+				overlaps = append(overlaps, fmt.Sprintf("%s [%s] overlaps %s [%s]", a.block, a.subnet.str("name"), b.block, b.subnet.str("name")))
+			}
+		}
+	}
+	return views, overlaps, nil
+}
+
+// SHOW ipam subnet <ID> | SHOW ipam domain <ID>
+func Show(args ...string) (string, error) {
+	const format = "Format: SHOW ipam subnet <ID> | SHOW ipam domain <ID>"
+
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	if len(args) != 3 || args[0] != "ipam" {
+		return format, nil
+	}
+
+	switch args[1] {
+	case "subnet":
+		sn := vspk.NewSubnet()
+		sn.ID = args[2]
+		if err := sn.Fetch(); err != nil {
+			return "", err
+		}
+
+		v, err := fetchsubnetipam(cmdctx, sn)
+		if err != nil {
+			return "", err
+		}
+
+		v.print()
+
+		held := make([]map[string]interface{}, len(v.allocations))
+		for i, a := range v.allocations {
+			held[i] = a.obj.attrs
+		}
+		keep(held)
+		return "SHOW ipam subnet -- done", nil
+
+	case "domain":
+		d := vspk.NewDomain()
+		d.ID = args[2]
+		if err := d.Fetch(); err != nil {
+			return "", err
+		}
+
+		views, overlaps, err := fetchdomainipam(cmdctx, d)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Printf("\n ######## Domain [%s] ID [%s]: %d subnets ########\n", d.Name, d.ID, len(views))
+		fmt.Printf("\n    %-24s %-20s %-16s %8s %8s %8s %s\n", "Subnet", "Address block", "Gateway", "Usable", "Used", "Used %", "Conflicts")
+
+		usable, used := 0, 0
+		subnets := make([]map[string]interface{}, len(views))
+		for i, v := range views {
+			block := "-"
+			if v.block != nil {
+				block = v.block.String()
+			}
+			fmt.Printf("    %-24s %-20s %-16s %8d %8d %7.1f%% %d\n", v.subnet.str("name"), block, v.subnet.str("gateway"), v.usable, v.used, v.utilisation(), len(v.conflicts))
+
+			usable, used = usable+v.usable, used+v.used
+			subnets[i] = v.subnet.attrs
+		}
+
+		if usable > 0 {
+			fmt.Printf("\n    Total: %d usable addresses, %d allocated (%.1f%%)\n", usable, used, 100*float64(used)/float64(usable))
+		}
+
+		if len(overlaps) > 0 {
+			fmt.Println("\n    Overlapping address blocks:")
+			for _, o := range overlaps {
+				fmt.Printf("    %s\n", o)
+			}
+		}
+
+		keep(subnets)
+		return "SHOW ipam domain -- done", nil
+	}
+	return format, nil
+}
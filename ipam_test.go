@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Inventory of a subnet 10.0.0.0/29, gateway 10.0.0.1, and the given address holders
+func testsubnet(t *testing.T, holders map[string]string) (*inventory, *invobject) {
+	t.Helper()
+
+	inv := newinventory()
+	inv.add("subnets", []byte(`[{"ID": "s1", "name": "sn", "address": "10.0.0.0", "netmask": "255.255.255.248", "gateway": "10.0.0.1"}]`))
+	for entity, list := range holders {
+		if err := inv.add(entity, []byte(list)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inv, inv.objects["s1"]
+}
+
+func TestSubnetIPAM(t *testing.T) {
+	tests := []struct {
+		name      string
+		holders   map[string]string
+		used      int
+		free      []string
+		conflicts []string
+	}{
+		{"empty", nil,
+			1, []string{"10.0.0.2 - 10.0.0.6 (5)"}, nil},
+		{"interfaces", map[string]string{
+			"vminterfaces":        `[{"ID": "i1", "name": "eth0", "IPAddress": "10.0.0.2", "MAC": "fa:16:3e:00:00:01"}]`,
+			"containerinterfaces": `[{"ID": "i2", "name": "eth0", "IPAddress": "10.0.0.5"}]`,
+		}, 3, []string{"10.0.0.3 - 10.0.0.4 (2)", "10.0.0.6"}, nil},
+		{"reservation for the MAC holding the address", map[string]string{
+			"vminterfaces":   `[{"ID": "i1", "name": "eth0", "IPAddress": "10.0.0.2", "MAC": "fa:16:3e:00:00:01"}]`,
+			"ipreservations": `[{"ID": "r1", "IPAddress": "10.0.0.2", "MAC": "FA:16:3E:00:00:01"}]`,
+		}, 2, []string{"10.0.0.3 - 10.0.0.6 (4)"}, nil},
+		{"duplicate", map[string]string{
+			"vminterfaces": `[{"ID": "i1", "name": "a", "IPAddress": "10.0.0.3", "MAC": "fa:16:3e:00:00:01"},
+				{"ID": "i2", "name": "b", "IPAddress": "10.0.0.3", "MAC": "fa:16:3e:00:00:02"}]`,
+		}, 2, []string{"10.0.0.2", "10.0.0.4 - 10.0.0.6 (3)"},
+			[]string{"10.0.0.3: Duplicate -- vminterface a [i1], vminterface b [i2]"}},
+		{"gateway, broadcast and outside", map[string]string{
+			"vminterfaces": `[{"ID": "i1", "name": "a", "IPAddress": "10.0.0.1"}, {"ID": "i2", "name": "b", "IPAddress": "10.0.0.7"},
+				{"ID": "i3", "name": "c", "IPAddress": "10.9.9.9"}, {"ID": "i4", "name": "d", "IPAddress": "2001:db8::1"}]`,
+		}, 1, []string{"10.0.0.2 - 10.0.0.6 (5)"},
+			[]string{"10.0.0.1: Gateway address -- vminterface a [i1]", "10.0.0.7: Network / broadcast address -- vminterface b [i2]",
+				"10.9.9.9: Outside the subnet -- vminterface c [i3]"}},
+	}
+
+	for _, tt := range tests {
+		inv, sn := testsubnet(t, tt.holders)
+		v := inv.subnetipam(sn)
+
+		var free []string
+		for _, r := range v.free {
+			free = append(free, r.String())
+		}
+
+		if v.usable != 6 || v.used != tt.used {
+			t.Errorf("%s: usable %d, used %d, want 6, %d", tt.name, v.usable, v.used, tt.used)
+		}
+		if !reflect.DeepEqual(free, tt.free) {
+			t.Errorf("%s: free %q, want %q", tt.name, free, tt.free)
+		}
+		if !reflect.DeepEqual(v.conflicts, tt.conflicts) {
+			t.Errorf("%s: conflicts %q, want %q", tt.name, v.conflicts, tt.conflicts)
+		}
+	}
+
+	// No address
+	inv := newinventory()
+	inv.add("subnets", []byte(`[{"ID": "s2", "name": "v6only"}]`))
+	if v := inv.subnetipam(inv.objects["s2"]); len(v.conflicts) != 1 || v.usable != 0 {
+		t.Errorf("Subnet without an IPv4 address: conflicts %q, usable %d", v.conflicts, v.usable)
+	}
+}
+
+func TestNextFree(t *testing.T) {
+	tests := []struct {
+		name    string
+		holders map[string]string
+		count   int
+		want    string
+	}{
+		{"first", nil, 1, "10.0.0.2"},
+		{"several", nil, 3, "10.0.0.2 10.0.0.3 10.0.0.4"},
+		{"all, and no more", nil, 10, "10.0.0.2 10.0.0.3 10.0.0.4 10.0.0.5 10.0.0.6"},
+		{"past allocations", map[string]string{
+			"vminterfaces": `[{"ID": "i1", "IPAddress": "10.0.0.2"}, {"ID": "i2", "IPAddress": "10.0.0.4"}]`,
+		}, 2, "10.0.0.3 10.0.0.5"},
+		{"outside address ranges", map[string]string{
+			"addressranges": `[{"ID": "a1", "minAddress": "10.0.0.2", "maxAddress": "10.0.0.4"}]`,
+		}, 2, "10.0.0.5 10.0.0.6"},
+		{"full", map[string]string{
+			"addressranges": `[{"ID": "a1", "minAddress": "10.0.0.2", "maxAddress": "10.0.0.6"}]`,
+		}, 1, ""},
+	}
+
+	for _, tt := range tests {
+		inv, sn := testsubnet(t, tt.holders)
+
+		var ips []string
+		for _, ip := range inv.subnetipam(sn).nextfree(tt.count) {
+			ips = append(ips, ip.String())
+		}
+		if got := strings.Join(ips, " "); got != tt.want {
+			t.Errorf("%s: nextfree(%d) = %q, want %q", tt.name, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestIPRange(t *testing.T) {
+	_, block, _ := net.ParseCIDR("192.168.1.0/24")
+	if first, last := blockrange(block); ipfrom(first).String() != "192.168.1.0" || ipfrom(last).String() != "192.168.1.255" {
+		t.Errorf("blockrange(%s) = %s, %s", block, ipfrom(first), ipfrom(last))
+	}
+	if s := (iprange{ip4(net.ParseIP("10.0.0.1")), ip4(net.ParseIP("10.0.0.1"))}).String(); s != "10.0.0.1" {
+		t.Errorf("iprange.String() = %q, want 10.0.0.1", s)
+	}
+
+	// The whole address space
+	_, block, _ = net.ParseCIDR("0.0.0.0/0")
+	if first, last := blockrange(block); first != 0 || last != 0xffffffff {
+		t.Errorf("blockrange(%s) = %s, %s", block, ipfrom(first), ipfrom(last))
+	}
+	if s := (iprange{0, 0xffffffff}).String(); s != "0.0.0.0 - 255.255.255.255 (4294967296)" {
+		t.Errorf("iprange.String() = %q", s)
+	}
+}
+
+func TestLargeSubnetIPAM(t *testing.T) {
+	inv := newinventory()
+	inv.add("subnets", []byte(`[{"ID": "s1", "name": "sn", "address": "0.0.0.0", "netmask": "0.0.0.0", "gateway": "0.0.0.1"}]`))
+	inv.add("vminterfaces", []byte(`[{"ID": "i1", "name": "eth0", "IPAddress": "10.0.0.1"}]`))
+	inv.add("addressranges", []byte(`[{"ID": "a1", "minAddress": "0.0.0.2", "maxAddress": "9.255.255.255"}]`))
+
+	v := inv.subnetipam(inv.objects["s1"])
+	var free []string
+	for _, r := range v.free {
+		free = append(free, r.String())
+	}
+	want := []string{"0.0.0.2 - 10.0.0.0 (167772159)", "10.0.0.2 - 255.255.255.254 (4127195133)"}
+	if v.usable != 1<<32-2 || v.used != 2 || !reflect.DeepEqual(free, want) {
+		t.Errorf("0.0.0.0/0: usable %d, used %d, free %q, want %q", v.usable, v.used, free, want)
+	}
+
+	var ips []string
+	for _, ip := range v.nextfree(2) {
+		ips = append(ips, ip.String())
+	}
+	if got := strings.Join(ips, " "); got != "10.0.0.0 10.0.0.2" {
+		t.Errorf("0.0.0.0/0: nextfree(2) = %q, want 10.0.0.0 10.0.0.2", got)
+	}
+}
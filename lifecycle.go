@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// VM and container lifecycle, as orchestrators drive it: A vport is created in the subnet for each interface, then the VM
+// (container) is created with its interfaces -- MAC address, vport, and optionally a static IP address. VSD resolves the
+// interfaces and assigns their addresses. An interface is moved to another subnet by deleting it (DETACH) and creating
+// it on its new vport (ATTACH).
+
+// Interface, as given on the command line: mac=<MAC>,subnet=<SubnetID>[,ip=<IP>] or mac=<MAC>,vport=<VPortID>[,ip=<IP>]
+type ifspec struct {
+	mac, subnet, vport, ip string
+}
+
+const ifformat = "<interface>: mac=<MAC>,subnet=<SubnetID>[,ip=<IP>] | mac=<MAC>,vport=<VPortID>[,ip=<IP>]"
+
+func parseifspec(arg string) (*ifspec, error) {
+	s := new(ifspec)
+
+	for _, kv := range strings.Split(arg, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid interface [%s] -- %s", arg, ifformat)
+		}
+
+		switch k, v := kv[:i], kv[i+1:]; k {
+		case "mac":
+			mac, err := net.ParseMAC(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid interface [%s]: %s", arg, err)
+			}
+			s.mac = mac.String()
+		case "subnet":
+			s.subnet = v
+		case "vport":
+			s.vport = v
+		case "ip":
+			if net.ParseIP(v).To4() == nil {
+				return nil, fmt.Errorf("Invalid interface [%s]: Invalid IPv4 address %s", arg, v)
+			}
+			s.ip = v
+		default:
+			return nil, fmt.Errorf("Invalid interface [%s] -- %s", arg, ifformat)
+		}
+	}
+
+	if s.mac == "" || (s.subnet == "") == (s.vport == "") {
+		return nil, fmt.Errorf("Invalid interface [%s]: A MAC address and either a subnet or a vport are required -- %s", arg, ifformat)
+	}
+	return s, nil
+}
+
+// Parse the interfaces of CREATE / ATTACH. Interfaces given by subnet need "--create-vports"
+func parseifspecs(args []string) ([]*ifspec, error) {
+	var specs []*ifspec
+
+	createvports := false
+	for _, arg := range args {
+		if arg == "--create-vports" {
+			createvports = true
+		}
+	}
+
+	for _, arg := range args {
+		if arg == "--create-vports" {
+			continue
+		}
+
+		s, err := parseifspec(arg)
+		if err != nil {
+			return nil, err
+		}
+		if s.subnet != "" && !createvports {
+			return nil, fmt.Errorf("Interface [%s]: No vport -- give vport=<VPortID>, or use --create-vports", arg)
+		}
+		specs = append(specs, s)
+	}
+
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("No interfaces given -- %s", ifformat)
+	}
+	return specs, nil
+}
+
+// Random (version 4) UUID, as orchestrators assign to their VMs and containers
+func newuuid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Name for a new vport: "<owner name>-<MAC without colons>", with a "-2", "-3" ... suffix if a vport of that name exists
+func vportname(owner, mac string) (string, error) {
+	base := owner + "-" + strings.Replace(mac, ":", "", -1)
+
+	vpl, err := root.VPorts(&bambou.FetchingInfo{Filter: fmt.Sprintf("name BEGINSWITH %q", base)})
+	if err != nil {
+		return "", err
+	}
+	taken := make(map[string]bool)
+	for _, vp := range vpl {
+		taken[vp.Name] = true
+	}
+
+	// One of the first len(vpl)+1 names is free
+	name := base
+	for n := 2; taken[name]; n++ {
+		name = fmt.Sprintf("%s-%d", base, n)
+	}
+	return name, nil
+}
+
+// Create the vports of the interfaces given by subnet, named after the owner and the MAC address. Returns the vports
+// created
+func createvports(specs []*ifspec, owner, vptype string) ([]*vspk.VPort, error) {
+	var created []*vspk.VPort
+
+	for _, s := range specs {
+		if s.vport != "" {
+			continue
+		}
+
+		name, err := vportname(owner, s.mac)
+		if err != nil {
+			return created, err
+		}
+
+		vp := vspk.NewVPort()
+		vp.Name = name
+		vp.Type = vptype
+		vp.AddressSpoofing = "INHERITED"
+		vp.Active = true
+
+		subnet := vspk.NewSubnet()
+		subnet.ID = s.subnet
+
+		rec, err := newaudit("CREATE", []string{"vport", vp.Name, s.subnet}, "vport", "")
+		if err != nil {
+			return created, err
+		}
+		if err := subnet.CreateVPort(vp); err != nil {
+			rec.done(err)
+			return created, err
+		}
+		rec.ID = vp.ID
+		rec.after(vp)
+		rec.done(nil)
+
+		fmt.Printf("  vport [%s] ID [%s] created in subnet [%s]\n", vp.Name, vp.ID, s.subnet)
+		s.vport = vp.ID
+		created = append(created, vp)
+	}
+	return created, nil
+}
+
+// Delete the vports created for a VM / container that could not be created
+func rollbackvports(created []*vspk.VPort) {
+	for _, vp := range created {
+		rec, err := newaudit("DELETE", []string{"vport", vp.ID}, "vport", vp.ID)
+		if err != nil {
+			fmt.Printf("Warning: Not deleting vport [%s] ID [%s]: %s\n", vp.Name, vp.ID, err)
+			continue
+		}
+		rec.before(vp)
+
+		if err := vp.Delete(); err != nil {
+			rec.done(err)
+			fmt.Printf("Warning: Deleting vport [%s] ID [%s] failed: %s\n", vp.Name, vp.ID, err)
+			continue
+		}
+		rec.done(nil)
+		fmt.Printf("  vport [%s] ID [%s] deleted\n", vp.Name, vp.ID)
+	}
+}
+
+// The vports created for interfaces not attached
+func unused(created []*vspk.VPort, specs []*ifspec) []*vspk.VPort {
+	var vpl []*vspk.VPort
+	for _, vp := range created {
+		for _, s := range specs {
+			if s.vport == vp.ID {
+				vpl = append(vpl, vp)
+			}
+		}
+	}
+	return vpl
+}
+
+// Print a VM / container interface
+func printinterface(intf interface{}) {
+	name, _ := attribute(intf, "name")
+	id, _ := attribute(intf, "ID")
+	mac, _ := attribute(intf, "MAC")
+	ip, _ := attribute(intf, "IPAddress")
+	vport, _ := attribute(intf, "VPortID")
+	network, _ := attribute(intf, "attachedNetworkID")
+
+	fmt.Printf("  Interface [%s] ID [%s]  MAC [%s]  IP [%s]  VPort [%s]  Subnet [%s]\n", name, id, mac, ip, vport, network)
+}
+
+// CREATE vm | container <Name> [ --uuid <UUID> ] [ --create-vports ] <interface> ...
+func createvm(entity string, args []string) (string, error) {
+	format := "Format: CREATE " + entity + " <Name> [ --uuid <UUID> ] [ --create-vports ] <interface> ...\n    " + ifformat
+
+	if len(args) < 2 {
+		return format, nil
+	}
+
+	name, uuid := args[0], newuuid()
+	args = args[1:]
+	if len(args) >= 2 && args[0] == "--uuid" {
+		uuid, args = args[1], args[2:]
+	}
+
+	specs, err := parseifspecs(args)
+	if err != nil {
+		return err.Error() + "\n" + format, nil
+	}
+
+	vptype := "VM"
+	if entity == "container" {
+		vptype = "CONTAINER"
+	}
+
+	created, err := createvports(specs, name, vptype)
+	if err != nil {
+		rollbackvports(created)
+		return "", err
+	}
+
+	var (
+		obj    interface{}
+		create func() *bambou.Error
+	)
+
+	switch entity {
+	case "vm":
+		vm := vspk.NewVM()
+		vm.Name, vm.UUID = name, uuid
+		for _, s := range specs {
+			vm.Interfaces = append(vm.Interfaces, &vspk.VMInterface{MAC: s.mac, VPortID: s.vport, IPAddress: s.ip})
+		}
+		obj, create = vm, func() *bambou.Error { return root.CreateVM(vm) }
+
+	case "container":
+		c := vspk.NewContainer()
+		c.Name, c.UUID = name, uuid
+		for _, s := range specs {
+			c.Interfaces = append(c.Interfaces, &vspk.ContainerInterface{MAC: s.mac, VPortID: s.vport, IPAddress: s.ip})
+		}
+		obj, create = c, func() *bambou.Error { return root.CreateContainer(c) }
+	}
+
+	rec, err := newaudit("CREATE", append([]string{entity, name}, args...), entity, "")
+	if err != nil {
+		rollbackvports(created)
+		return "", err
+	}
+
+	if err := create(); err != nil {
+		rec.done(err)
+		rollbackvports(created)
+		return "", err
+	}
+
+	rec.ID, _ = attribute(obj, "ID")
+	rec.after(obj)
+	rec.done(nil)
+
+	keep(obj)
+
+	jsonobj, _ := json.MarshalIndent(obj, "", "\t")
+	fmt.Printf("\n ===> Created %s: Name [%s] <=== \n%s\n", entity, name, string(jsonobj))
+
+	// The interfaces as resolved by VSD, with their addresses
+	switch o := obj.(type) {
+	case *vspk.VM:
+		if il, err := o.VMInterfaces(&bambou.FetchingInfo{}); err == nil {
+			for _, intf := range il {
+				printinterface(intf)
+			}
+		}
+	case *vspk.Container:
+		if il, err := o.ContainerInterfaces(&bambou.FetchingInfo{}); err == nil {
+			for _, intf := range il {
+				printinterface(intf)
+			}
+		}
+	}
+
+	return "CREATE " + entity + " -- done", nil
+}
+
+// ATTACH vm | container <ID> [ --create-vports ] <interface> ...
+func Attach(args ...string) (string, error) {
+	const format = "Format: ATTACH vm | container <ID> [ --create-vports ] <interface> ...\n    " + ifformat
+
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	if len(args) < 3 || (args[0] != "vm" && args[0] != "container") {
+		return format, nil
+	}
+	entity, id := args[0], args[1]
+
+	specs, err := parseifspecs(args[2:])
+	if err != nil {
+		return err.Error() + "\n" + format, nil
+	}
+
+	var (
+		name, vptype string
+		vm           *vspk.VM
+		c            *vspk.Container
+	)
+
+	switch entity {
+	case "vm":
+		vm = vspk.NewVM()
+		vm.ID = id
+		if err := vm.Fetch(); err != nil {
+			return "", err
+		}
+		name, vptype = vm.Name, "VM"
+	case "container":
+		c = vspk.NewContainer()
+		c.ID = id
+		if err := c.Fetch(); err != nil {
+			return "", err
+		}
+		name, vptype = c.Name, "CONTAINER"
+	}
+
+	created, err := createvports(specs, name, vptype)
+	if err != nil {
+		rollbackvports(created)
+		return "", err
+	}
+
+	var attached []interface{}
+
+	for i, s := range specs {
+		var (
+			intf   interface{}
+			create func() *bambou.Error
+		)
+
+		if vm != nil {
+			vmi := &vspk.VMInterface{MAC: s.mac, VPortID: s.vport, IPAddress: s.ip}
+			intf, create = vmi, func() *bambou.Error { return vm.CreateVMInterface(vmi) }
+		} else {
+			ci := &vspk.ContainerInterface{MAC: s.mac, VPortID: s.vport, IPAddress: s.ip}
+			intf, create = ci, func() *bambou.Error { return c.CreateContainerInterface(ci) }
+		}
+
+		rec, err := newaudit("ATTACH", args, entity+"interface", "")
+		if err != nil {
+			rollbackvports(unused(created, specs[i:]))
+			return "", err
+		}
+		if err := create(); err != nil {
+			rec.done(err)
+			rollbackvports(unused(created, specs[i:]))
+			return "", err
+		}
+		rec.ID, _ = attribute(intf, "ID")
+		rec.after(intf)
+		rec.done(nil)
+
+		printinterface(intf)
+		attached = append(attached, intf)
+	}
+	keep(attached)
+
+	return fmt.Sprintf("ATTACH -- done, %d interface(s) attached to %s [%s]", len(attached), entity, name), nil
+}
+
+// DETACH vminterface | containerinterface <ID> [ --delete-vport ]
+func Detach(args ...string) (string, error) {
+	const format = "Format: DETACH vminterface | containerinterface <ID> [ --delete-vport ]"
+
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	if (len(args) != 2 && (len(args) != 3 || args[2] != "--delete-vport")) ||
+		(args[0] != "vminterface" && args[0] != "containerinterface") {
+		return format, nil
+	}
+	entity, id := args[0], args[1]
+
+	intf := newobject(entity, id)
+	if err := intf.Fetch(); err != nil {
+		return "", err
+	}
+
+	rec, err := newaudit("DETACH", args, entity, id)
+	if err != nil {
+		return "", err
+	}
+	rec.before(intf)
+
+	if err := intf.Delete(); err != nil {
+		rec.done(err)
+		return "", err
+	}
+	rec.done(nil)
+
+	// The detached interface -- its MAC and IP address -- can be re-attached with "$_.MAC", "$_.IPAddress"
+	keep(intf)
+	printinterface(intf)
+
+	if len(args) == 2 {
+		lastdeleted = &stash{entity: entity, obj: intf}
+		return "DETACH -- done", nil
+	}
+
+	vportid, _ := attribute(intf, "VPortID")
+	vp := vspk.NewVPort()
+	vp.ID = vportid
+
+	vrec, err := newaudit("DETACH", args, "vport", vportid)
+	if err != nil {
+		return "", err
+	}
+	if err := vp.Fetch(); err == nil {
+		vrec.before(vp)
+	}
+	if err := vp.Delete(); err != nil {
+		vrec.done(err)
+		return "Interface detached, but deleting its vport failed", err
+	}
+	vrec.done(nil)
+
+	lastdeleted = nil
+	return "DETACH -- done, vport [" + vp.Name + "] ID [" + vportid + "] deleted", nil
+}
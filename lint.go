@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// LINT: Consistency checks across enterprises -- what broken orchestrators leave behind. Orphans can be deleted ("--fix"),
+// each after confirmation, through DELETE.
+
+const (
+	lintError = iota
+	lintWarning
+	lintInfo
+)
+
+var lintseverities = []string{"ERROR", "WARNING", "INFO"}
+
+type lintfinding struct {
+	severity int
+
+	// Object the finding is about, and where it is: enterprise / domain ...
+	entity, id, name, where string
+
+	problem string
+
+	// Whether "--fix" can delete the object
+	fixable bool
+}
+
+type linter struct {
+	sync.Mutex
+
+	findings []*lintfinding
+
+	// Vports found, by ID
+	vports map[string]bool
+
+	containers bool
+}
+
+func (l *linter) report(severity int, entity, id, name, where, problem string, fixable bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.findings = append(l.findings, &lintfinding{severity, entity, id, name, where, problem, fixable})
+}
+
+// Report an object that could not be checked -- unless the command was interrupted
+func (l *linter) failed(entity, id, name, where, what string, err error) {
+	if cmdctx.Err() != nil {
+		return
+	}
+	if what != "" {
+		what = " " + what
+	}
+	l.report(lintWarning, entity, id, name, where, "Cannot check"+what+": "+err.Error(), false)
+}
+
+// Check n objects on a pool of workers, reporting those that could not be checked -- and going on with the others.
+// Fails only if interrupted
+func (l *linter) fanout(ctx context.Context, n int, fn func(ctx context.Context, i int) error, failed func(i int, err error)) error {
+	errs, err := fanouteach(ctx, n, fn)
+	if err != nil {
+		return err
+	}
+	for i, e := range errs {
+		if e != nil {
+			failed(i, e)
+		}
+	}
+	return nil
+}
+
+// Check an enterprise: Its domains and L2 domains first, then its VMs and containers -- whose interfaces refer to their
+// vports
+func (l *linter) enterprise(ctx context.Context, org *vspk.Enterprise) error {
+	// Without them, domain templates are checked one by one
+	templates := make(map[string]bool)
+	dtl, err := org.DomainTemplates(&bambou.FetchingInfo{})
+	if err != nil {
+		l.failed("enterprise", org.ID, org.Name, org.Name, "domain templates", err)
+	}
+	for _, dt := range dtl {
+		templates[dt.ID] = true
+	}
+
+	dl, err := org.Domains(&bambou.FetchingInfo{})
+	if err != nil {
+		l.failed("enterprise", org.ID, org.Name, org.Name, "domains", err)
+	}
+	if ferr := l.fanout(ctx, len(dl), func(ctx context.Context, i int) error {
+		return l.domain(ctx, org, dl[i], templates)
+	}, func(i int, err error) {
+		l.failed("domain", dl[i].ID, dl[i].Name, org.Name, "", err)
+	}); ferr != nil {
+		return ferr
+	}
+
+	l2l, err := org.L2Domains(&bambou.FetchingInfo{})
+	if err != nil {
+		l.failed("enterprise", org.ID, org.Name, org.Name, "L2 domains", err)
+	}
+	if ferr := l.fanout(ctx, len(l2l), func(ctx context.Context, i int) error {
+		vpl, err := l2l[i].VPorts(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		return l.vportlist(ctx, org.Name+"/"+l2l[i].Name, vpl)
+	}, func(i int, err error) {
+		l.failed("l2domain", l2l[i].ID, l2l[i].Name, org.Name, "vports", err)
+	}); ferr != nil {
+		return ferr
+	}
+
+	vml, err := org.VMs(&bambou.FetchingInfo{})
+	if err != nil {
+		l.failed("enterprise", org.ID, org.Name, org.Name, "VMs", err)
+	}
+	if ferr := l.fanout(ctx, len(vml), func(ctx context.Context, i int) error {
+		il, err := vml[i].VMInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		var interfaces []interface{}
+		for _, intf := range il {
+			interfaces = append(interfaces, intf)
+		}
+		l.interfaces("vm", vml[i].ID, vml[i].Name, org.Name, interfaces)
+		return nil
+	}, func(i int, err error) {
+		l.failed("vm", vml[i].ID, vml[i].Name, org.Name, "interfaces", err)
+	}); ferr != nil {
+		return ferr
+	}
+
+	if !l.containers {
+		return nil
+	}
+
+	cl, err := org.Containers(&bambou.FetchingInfo{})
+	if err != nil {
+		l.failed("enterprise", org.ID, org.Name, org.Name, "containers", err)
+	}
+	return l.fanout(ctx, len(cl), func(ctx context.Context, i int) error {
+		il, err := cl[i].ContainerInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		var interfaces []interface{}
+		for _, intf := range il {
+			interfaces = append(interfaces, intf)
+		}
+		l.interfaces("container", cl[i].ID, cl[i].Name, org.Name, interfaces)
+		return nil
+	}, func(i int, err error) {
+		l.failed("container", cl[i].ID, cl[i].Name, org.Name, "interfaces", err)
+	})
+}
+
+// Check the interfaces of a VM / container: There are some, and their vports exist
+func (l *linter) interfaces(entity, id, name, where string, interfaces []interface{}) {
+	if len(interfaces) == 0 {
+		l.report(lintWarning, entity, id, name, where, "No interfaces", true)
+		return
+	}
+
+	for _, intf := range interfaces {
+		vportid, _ := attribute(intf, "VPortID")
+		iid, _ := attribute(intf, "ID")
+		iname, _ := attribute(intf, "name")
+
+		if vportid == "" {
+			l.report(lintError, entity+"interface", iid, iname, where+"/"+name, "Not attached to a vport", true)
+			continue
+		}
+
+		l.Lock()
+		known := l.vports[vportid]
+		l.Unlock()
+		if known {
+			continue
+		}
+
+		// The vport may be in another enterprise. Only a vport VSD does not know is deleted
+		vp := vspk.NewVPort()
+		vp.ID = vportid
+		err := vp.Fetch()
+		switch {
+		case err == nil:
+		case notfound(err):
+			l.report(lintError, entity+"interface", iid, iname, where+"/"+name, "Attached to deleted vport ["+vportid+"]", true)
+		default:
+			l.report(lintWarning, entity+"interface", iid, iname, where+"/"+name, "Cannot check vport ["+vportid+"]: "+err.Error(), false)
+		}
+	}
+}
+
+func (l *linter) domain(ctx context.Context, org *vspk.Enterprise, d *vspk.Domain, templates map[string]bool) error {
+	where := org.Name + "/" + d.Name
+
+	if d.TemplateID != "" && !templates[d.TemplateID] {
+		dt := vspk.NewDomainTemplate()
+		dt.ID = d.TemplateID
+		err := dt.Fetch()
+		switch {
+		case err == nil:
+		case notfound(err):
+			l.report(lintError, "domain", d.ID, d.Name, org.Name, "Instantiated from deleted domain template ["+d.TemplateID+"]", false)
+		default:
+			l.report(lintWarning, "domain", d.ID, d.Name, org.Name, "Cannot check domain template ["+d.TemplateID+"]: "+err.Error(), false)
+		}
+	}
+
+	// Objects ACL entries may refer to
+	ids := make(map[string]bool)
+
+	// ACL entries are only checked if all of them are known
+	zl, zerr := d.Zones(&bambou.FetchingInfo{})
+	if zerr != nil {
+		l.failed("domain", d.ID, d.Name, org.Name, "zones", zerr)
+	}
+	sl, serr := d.Subnets(&bambou.FetchingInfo{})
+	if serr != nil {
+		l.failed("domain", d.ID, d.Name, org.Name, "subnets", serr)
+	}
+	pgl, perr := d.PolicyGroups(&bambou.FetchingInfo{})
+	if perr != nil {
+		l.failed("domain", d.ID, d.Name, org.Name, "policy groups", perr)
+	}
+
+	for _, sn := range sl {
+		ids[sn.ID] = true
+	}
+	for _, pg := range pgl {
+		ids[pg.ID] = true
+	}
+
+	subnets := make(map[string]int)
+	for _, sn := range sl {
+		subnets[sn.ParentID]++
+	}
+	for _, z := range zl {
+		ids[z.ID] = true
+		if serr == nil && subnets[z.ID] == 0 {
+			l.report(lintInfo, "zone", z.ID, z.Name, where, "Empty zone: No subnets", true)
+		}
+	}
+
+	var acls []*aclentry
+	if zerr == nil && serr == nil && perr == nil {
+		var aerr error
+		if acls, aerr = fetchacls(d); aerr != nil {
+			l.failed("domain", d.ID, d.Name, org.Name, "ACL entries", aerr)
+		}
+	}
+	for _, e := range acls {
+		var dangling []string
+		for _, ref := range [][2]string{{e.locationtype, e.locationid}, {e.networktype, e.networkid}} {
+			switch ref[0] {
+			case "SUBNET", "ZONE", "POLICYGROUP":
+				if !ids[ref[1]] {
+					dangling = append(dangling, strings.ToLower(ref[0])+" ["+ref[1]+"]")
+				}
+			}
+		}
+		if len(dangling) > 0 {
+			l.report(lintError, strings.ToLower(e.direction)+"aclentrytemplate", e.id, e.description, where+"/"+e.template,
+				fmt.Sprintf("Priority %d: Refers to deleted %s", e.priority, strings.Join(dangling, ", ")), true)
+		}
+	}
+
+	vpl, err := d.VPorts(&bambou.FetchingInfo{})
+	if err != nil {
+		l.failed("domain", d.ID, d.Name, org.Name, "vports", err)
+		return nil
+	}
+	return l.vportlist(ctx, where, vpl)
+}
+
+// Check the vports of a domain / L2 domain: Interfaces are attached to them
+func (l *linter) vportlist(ctx context.Context, where string, vpl vspk.VPortsList) error {
+	l.Lock()
+	for _, vp := range vpl {
+		l.vports[vp.ID] = true
+	}
+	l.Unlock()
+
+	return l.fanout(ctx, len(vpl), func(ctx context.Context, i int) error {
+		n, err := l.attached(vpl[i])
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			l.report(lintWarning, "vport", vpl[i].ID, vpl[i].Name, where, "No interfaces attached", true)
+		}
+		return nil
+	}, func(i int, err error) {
+		l.failed("vport", vpl[i].ID, vpl[i].Name, where, "interfaces", err)
+	})
+}
+
+// Number of interfaces attached to a vport
+func (l *linter) attached(vp *vspk.VPort) (int, error) {
+	vmil, err := vp.VMInterfaces(&bambou.FetchingInfo{})
+	if err != nil {
+		return 0, err
+	}
+	hil, err := vp.HostInterfaces(&bambou.FetchingInfo{})
+	if err != nil {
+		return 0, err
+	}
+	bil, err := vp.BridgeInterfaces(&bambou.FetchingInfo{})
+	if err != nil {
+		return 0, err
+	}
+	n := len(vmil) + len(hil) + len(bil)
+
+	if l.containers {
+		cil, err := vp.ContainerInterfaces(&bambou.FetchingInfo{})
+		if err != nil {
+			return 0, err
+		}
+		n += len(cil)
+	}
+	return n, nil
+}
+
+// Offer to delete the fixable findings, one by one. Answers: y(es), n(o), a(ll remaining), q(uit)
+func (l *linter) fix() int {
+	deleted, all := 0, false
+
+	for _, f := range l.findings {
+		if !f.fixable {
+			continue
+		}
+		if cmdctx.Err() != nil {
+			break
+		}
+
+		if !all {
+			var answer string
+			fmt.Printf("Delete %s %s [%s] -- %s? [y/N/a/q] > ", f.entity, f.name, f.id, f.problem)
+			fmt.Scanln(&answer)
+
+			switch strings.ToLower(answer) {
+			case "y", "yes":
+			case "a", "all":
+				all = true
+			case "q", "quit":
+				return deleted
+			default:
+				continue
+			}
+		}
+
+		if err := run("DELETE " + f.entity + " " + f.id); err != nil {
+			fmt.Printf("Deleting %s [%s] failed: %s\n", f.entity, f.id, err)
+			continue
+		}
+		fmt.Printf("  %s %s [%s] deleted\n", f.entity, f.name, f.id)
+		deleted++
+	}
+	return deleted
+}
+
+// LINT enterprise <ID> | --all [ --fix ]
+func Lint(args ...string) (string, error) {
+	const format = "Format: LINT enterprise <ID> | --all [ --fix ]"
+
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	fix := len(args) > 0 && args[len(args)-1] == "--fix"
+	if fix {
+		args = args[:len(args)-1]
+	}
+
+	var orgs vspk.EnterprisesList
+
+	switch {
+	case len(args) == 1 && args[0] == "--all":
+		var err *bambou.Error
+		if orgs, err = root.Enterprises(&bambou.FetchingInfo{}); err != nil {
+			return "", err
+		}
+	case len(args) == 2 && args[0] == "enterprise":
+		org := vspk.NewEnterprise()
+		org.ID = args[1]
+		if err := org.Fetch(); err != nil {
+			return "", err
+		}
+		orgs = vspk.EnterprisesList{org}
+	default:
+		return format, nil
+	}
+
+	if fix && readonly {
+		return "Read-only mode: LINT --fix refused", nil
+	}
+
+	l := &linter{
+		vports:     make(map[string]bool),
+		containers: unsupported("LINT", "containers") == "",
+	}
+
+	// Enterprises that cannot be checked are reported, the others checked in full. Report what was found so far if
+	// interrupted
+	err := l.fanout(cmdctx, len(orgs), func(ctx context.Context, i int) error {
+		return l.enterprise(ctx, orgs[i])
+	}, func(i int, err error) {
+		l.failed("enterprise", orgs[i].ID, orgs[i].Name, orgs[i].Name, "", err)
+	})
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		a, b := l.findings[i], l.findings[j]
+		if a.severity != b.severity {
+			return a.severity < b.severity
+		}
+		if a.where != b.where {
+			return a.where < b.where
+		}
+		return a.entity < b.entity
+	})
+
+	counts := make([]int, len(lintseverities))
+	found := make([]map[string]interface{}, len(l.findings))
+	for i, f := range l.findings {
+		fmt.Printf("%-8s %-24s %-24s ID [%s]  [%s]  %s\n", lintseverities[f.severity], f.entity, f.name, f.id, f.where, f.problem)
+		counts[f.severity]++
+		found[i] = map[string]interface{}{
+			"ID":       f.id,
+			"name":     f.name,
+			"entity":   f.entity,
+			"severity": lintseverities[f.severity],
+			"problem":  f.problem,
+		}
+	}
+	keep(found)
+
+	summary := fmt.Sprintf("%d error(s), %d warning(s), %d info in %d enterprise(s)", counts[lintError], counts[lintWarning], counts[lintInfo], len(orgs))
+	if err != nil {
+		return "Interrupted -- " + summary + " so far", err
+	}
+
+	if fix {
+		summary += fmt.Sprintf(". %d object(s) deleted", l.fix())
+	}
+	return "LINT -- done: " + summary, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abiosoft/ishell"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Logging: Log level, destination (terminal or file) and format (text or JSON), and a log entry for every shell command
+// run -- with its duration and the session it ran in.
+//
+// logrus has no "trace" level: Level "trace" is "debug" plus HTTP tracing of all Nuage API calls (see "trace.go").
+
+var (
+	loglevel  = "info"
+	logfile   *os.File
+	logformat = "text"
+
+	// Whether HTTP tracing was turned on by "debuglevel trace"
+	tracebylevel bool
+)
+
+// Name of the session, as logged: The profile in use, or the VSD user and URL
+func sessionname() string {
+	if profilename != "" {
+		return profilename
+	}
+	return user + "@" + vsdurl
+}
+
+// Wraps a shell command so that each run is logged, with its duration
+func withlogging(name string, fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		start := time.Now()
+		out, err := fn(args...)
+
+		entry := log.WithFields(log.Fields{
+			"command":  strings.TrimSpace(name + " " + strings.Join(args, " ")),
+			"session":  sessionname(),
+			"duration": time.Since(start).String(),
+		})
+
+		if err != nil {
+			entry.WithField("error", err.Error()).Warn("Command failed")
+		} else {
+			entry.Debug("Command done")
+		}
+		return out, err
+	}
+}
+
+// Set the log level: trace | debug | info | warn | error
+func setloglevel(level string) bool {
+	level = strings.ToLower(level)
+
+	switch level {
+	case "trace":
+		log.SetLevel(log.DebugLevel)
+		if !tracing {
+			settrace("on")
+			tracebylevel = true
+		}
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	case "warn", "warning":
+		level = "warn"
+		log.SetLevel(log.WarnLevel)
+	case "error":
+		log.SetLevel(log.ErrorLevel)
+	default:
+		return false
+	}
+
+	if level != "trace" && tracebylevel {
+		settrace("off")
+		tracebylevel = false
+	}
+	loglevel = level
+	return true
+}
+
+func debuglevel(args ...string) (string, error) {
+	if len(args) > 1 || (len(args) == 1 && !setloglevel(args[0])) {
+		return "Format: debuglevel [ trace | debug | info | warn | error ]", nil
+	}
+	return "Debug level: " + loglevel, nil
+}
+
+// Send log entries to a file / back to the terminal
+func setlogfile(args ...string) (string, error) {
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "off":
+		log.SetOutput(os.Stderr)
+		if logfile != nil {
+			logfile.Close()
+			logfile = nil
+		}
+	case len(args) == 1:
+		f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return "", err
+		}
+		log.SetOutput(f)
+		if logfile != nil {
+			logfile.Close()
+		}
+		logfile = f
+	default:
+		return "Format: logfile [ <path> | off ]", nil
+	}
+
+	if logfile == nil {
+		return "Logging to the terminal", nil
+	}
+	return "Logging to " + logfile.Name(), nil
+}
+
+// Set the log format: text | json
+func setlogformat(args ...string) (string, error) {
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "text":
+		log.SetFormatter(&log.TextFormatter{})
+		logformat = args[0]
+	case len(args) == 1 && args[0] == "json":
+		log.SetFormatter(&log.JSONFormatter{})
+		logformat = args[0]
+	default:
+		return "Format: logformat [ text | json ]", nil
+	}
+	return "Log format: " + logformat, nil
+}
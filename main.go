@@ -3,8 +3,14 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/abiosoft/ishell"
@@ -24,6 +30,8 @@ var (
 	root      *vspk.Me
 	mysession *bambou.Session
 
+	shell *ishell.Shell
+
 	// vsdurl, org, user, passwd string
 	// Temporary defaults
 	vsdurl    = "https://172.16.254.7:7443"
@@ -32,6 +40,22 @@ var (
 	org       = "csp"
 	certfname = "/root/certlogin1.pem"
 	keyfname  = "/root/certlogin1-Key.pem"
+
+	// Nuage API version, as used in the API URLs: "<vsdurl>/nuage/api/<apiversion>"
+	apiversion = "v4_0"
+)
+
+const (
+	// Default port for the Nuage API
+	vsdport = "8443"
+
+	// Path of the Nuage API, relative to the VSD URL
+	apiprefix = "/nuage/api/"
+)
+
+var (
+	hostname         = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+	apiversionsyntax = regexp.MustCompile(`^[vV]?([0-9]+)(?:[._]([0-9]+))?$`)
 )
 
 ////////
@@ -42,11 +66,27 @@ func resetconn(args ...string) (string, error) {
 	if mysession != nil {
 		mysession.Reset()
 	}
-	// mysession = nil
+	if apirelay != nil {
+		apirelay.close()
+	}
+	mysession, apirelay, apitransport, connurl = nil, nil, nil, ""
+	forgetlogin()
 	root = nil
+	clientcert = nil
+	connversion, servercurrent, serverversions = "", "", nil
 	return "", nil
 }
 
+// Apply the shell settings to a new session, before starting it. "cert": The client certificate, if any
+func prepare(s *bambou.Session, cert *tls.Certificate) error {
+	clearcache()
+
+	if tlsinsecure {
+		fmt.Println("Warning: The VSD certificate is not verified (`tls insecure on`)")
+	}
+	return applytransport(s, cert)
+}
+
 // Establish Nuage API connection using user + password
 
 func makeconn(args ...string) (string, error) {
@@ -55,21 +95,29 @@ func makeconn(args ...string) (string, error) {
 		return "Invalid VSD url / user / password. Please set connection details using `setconn` command ", nil
 	}
 
-	mysession, root = vspk.NewSession(user, passwd, org, vsdurl)
+	root = vspk.NewMe()
+	mysession = bambou.NewSession(user, passwd, org, vsdurl+apiprefix+apiversion, root)
+	loginsecret = passwd
 
 	// fmt.Printf("===> My VSD URL is: %s\n", vsdurl)
 
 	// fmt.Printf("===> My Bambou session is: %#v\n", *mysession)
 
-	// mysession.SetInsecureSkipVerify(true)
+	if err := prepare(mysession, nil); err != nil {
+		resetconn()
+		return "", err
+	}
 
 	err := mysession.Start()
 
 	if err != nil {
 		resetconn()
 		fmt.Printf("Nuage API connection failed: ")
-		return "", err
+		return "", connerror(err)
 	} else {
+		if w := checkversions(); w != "" {
+			fmt.Println(w)
+		}
 		return "Nuage VSD connection established", nil
 	}
 }
@@ -82,25 +130,34 @@ func makecertconn(args ...string) (string, error) {
 		return "Invalid VSD url.Please set connection details using `setconn` command ", nil
 	}
 
-	if cert, err := tls.LoadX509KeyPair(certfname, keyfname); err != nil {
-
+	cert, err := loadcert()
+	if err != nil {
 		fmt.Printf("Loading TLS certificate and private key failed: ")
 		return "", err
-	} else {
-		mysession, root = vspk.NewX509Session(&cert, vsdurl)
 	}
 
+	root = vspk.NewMe()
+	mysession = bambou.NewX509Session(cert, vsdurl+apiprefix+apiversion, root)
+	loginsecret = ""
+
 	// fmt.Printf("===> My VSD URL is: %s\n", vsdurl)
 
 	// fmt.Printf("===> My Bambou session is: %#v\n", *mysession)
 
-	// mysession.SetInsecureSkipVerify(true)
+	if err := prepare(mysession, cert); err != nil {
+		resetconn()
+		return "", err
+	}
 
 	if err := mysession.Start(); err != nil {
 		resetconn()
 		fmt.Printf("Nuage TLS API connection failed: ")
-		return "", err
+		return "", connerror(err)
 	} else {
+		clientcert = cert.Leaf
+		if w := checkversions(); w != "" {
+			fmt.Println(w)
+		}
 		return "Nuage VSD TLS connection established", nil
 	}
 }
@@ -110,32 +167,110 @@ func displayconn(args ...string) (string, error) {
 	if root == nil {
 		return "Not Connected", nil
 	} else {
-		fmt.Printf("Nuage VSD connection established as:\n    VSD URL: [%s]\n    User: [%s]\n    Organization: [%s]\n", mysession.URL, mysession.Username, mysession.Organization)
+		fmt.Printf("Nuage VSD connection established as:\n    VSD URL: [%s]\n    User: [%s]\n    Organization: [%s]\n", connurl, mysession.Username, mysession.Organization)
+		fmt.Print(versionsummary())
+		fmt.Print(apikeysummary())
+		fmt.Printf("    TLS: %s\n", tlssummary())
+		if clientcert != nil {
+			fmt.Print(certsummary(clientcert))
+		}
+		if profilename != "" {
+			fmt.Printf("    Profile: [%s]\n", profilename)
+		}
+		if readonly {
+			fmt.Printf("    Read-only mode\n")
+		}
 		return "", nil
 	}
 
 }
 
+// Parse a VSD address given as an IP address (v4 or v6), a hostname -- both optionally with a port -- or as a full URL
+// with an optional path prefix, e.g. for VSDs behind a load balancer. Returns the VSD URL without the Nuage API path.
+func parsevsdurl(addr string) (string, error) {
+	full := strings.Contains(addr, "://")
+
+	if !full {
+		// Bare IPv6 address, without brackets or port
+		if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+			addr = "[" + addr + "]"
+		}
+		addr = "https://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("Unsupported URL scheme [%s] -- use https:// (or http://)", u.Scheme)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.New("VSD URL may not contain credentials, a query or a fragment")
+	}
+
+	host := u.Hostname()
+	if net.ParseIP(host) == nil && !hostname.MatchString(host) {
+		return "", fmt.Errorf("[%s] is neither a valid IP address nor a valid hostname", host)
+	}
+
+	// Bare addresses default to the Nuage API port. Full URLs default to the port of their scheme
+	port := u.Port()
+	if port == "" && !full {
+		port = vsdport
+	} else if n, err := strconv.Atoi(port); port != "" && (err != nil || n < 1 || n > 65535) {
+		return "", fmt.Errorf("Invalid port [%s]", port)
+	}
+
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	return u.Scheme + "://" + host + strings.TrimRight(u.EscapedPath(), "/"), nil
+}
+
+// Normalize a Nuage API version given as e.g. "v5_0", "5.0" or "5" to the form used in API URLs, i.e. "v5_0".
+// From 6 onwards, Nuage API versions have no minor number in the URL: "v6".
+func parseapiversion(v string) (string, error) {
+	m := apiversionsyntax.FindStringSubmatch(v)
+	if m == nil {
+		return "", fmt.Errorf("Invalid Nuage API version [%s] -- e.g. v4_0, 5.0 or 6", v)
+	}
+
+	major, _ := strconv.Atoi(m[1])
+	switch {
+	case m[2] != "":
+		return "v" + m[1] + "_" + m[2], nil
+	case major >= 6:
+		return "v" + m[1], nil
+	}
+	return "v" + m[1] + "_0", nil
+}
+
 // Set Nuage API connection details in top level vars
 func setconn(args ...string) (string, error) {
 	var (
 		err      error
-		vsdip    string
+		vsdaddr  string
+		version  string
 		bytepass []byte
 	)
 
-	fmt.Println("Set Nuage API connection Details: VSD IP address ; User ;  Password ")
+	fmt.Println("Set Nuage API connection Details: VSD address ; User ;  Password ; Organization ; API version")
 
-	// Get VSD IP
-	fmt.Print("\tEnter your VSD IP address > ")
-	_, err = fmt.Scanln(&vsdip)
+	// Get VSD address
+	fmt.Printf("\tEnter your VSD address -- IP address, hostname or URL [%s] > ", vsdurl)
+	_, err = fmt.Scanln(&vsdaddr)
 
 	if err == nil {
-		if net.ParseIP(vsdip) == nil {
-			return "'" + vsdip + "'" + " is not a valid IP address", nil
+		u, err := parsevsdurl(vsdaddr)
+		if err != nil {
+			return "'" + vsdaddr + "'" + " is not a valid VSD address: " + err.Error(), nil
 		}
-		// We assume (hardcode) that the URL for the Nuage API has the form "https://<VSD_ip_addr>:8443"
-		vsdurl = "https://" + vsdip + ":8443"
+		vsdurl = u
 	} else {
 		if err.Error() != "unexpected newline" { // If we just press Enter the VSD IP / URL remains the same as previous value
 			return "Error: ", err
@@ -168,7 +303,19 @@ func setconn(args ...string) (string, error) {
 		return "Error: ", err
 	}
 
-	// TBD: Insert code for changing the Nuage API version here. Currently only 4_0 (hardcoded)
+	// Get Nuage API version
+	fmt.Printf("\tEnter the Nuage API version [%s] > ", apiversion)
+	_, err = fmt.Scanln(&version)
+
+	if err == nil {
+		v, err := parseapiversion(version)
+		if err != nil {
+			return "", err
+		}
+		apiversion = v
+	} else if err.Error() != "unexpected newline" {
+		return "Error: ", err
+	}
 
 	return "", nil
 
@@ -183,67 +330,184 @@ func mygreet(args ...string) (string, error) {
 	return "Hello " + name, nil
 }
 
-// Set debug level
-func debuglevel(args ...string) (string, error) {
-	var loglevel string
-	fmt.Print("Set debug level: Debug (debug), Info: ")
-	_, err := fmt.Scanln(&loglevel)
-	if err != nil {
-		if err.Error() == "unexpected newline" {
-			// log.SetLevel(log.InfoLevel)
-			// return "Debug level now set to Info", nil
-			log.SetLevel(log.DebugLevel)
-			return "Debug level now set to Debug", nil
+func main() {
+
+	// nuage-vsd-shell mock-server ...: Run a mock VSD instead of the shell
+	if len(os.Args) > 1 && os.Args[1] == "mock-server" {
+		mockserver(os.Args[2:])
+		return
+	}
+
+	// Command line flags
+
+	var (
+		readonlyflag = flag.Bool("read-only", false, "Read-only mode: Refuse CREATE, DELETE, ATTACH, DETACH, UNDO and policy application")
+		profileflag  = flag.String("profile", "", "Use connection profile `name` from ~/"+profilefname)
+		certflag     = flag.String("cert", "", "Client certificate `file` for makecertconn: PEM, or PKCS#12 bundle (.p12 / .pfx)")
+		keyflag      = flag.String("key", "", "Private key `file` (PEM) for makecertconn")
+		traceflag    = flag.Bool("trace", false, "Trace all Nuage API calls")
+		tracefflag   = flag.String("trace-file", "", "With --trace, write the trace to `file` instead of the terminal")
+		levelflag    = flag.String("log-level", "", "Log `level`: trace, debug, info, warn or error")
+		logfileflag  = flag.String("log-file", "", "Write log entries to `file` instead of the terminal")
+		logjsonflag  = flag.Bool("log-json", false, "JSON formatted log entries")
+		replayflag   = flag.String("replay", "", "Replay the Nuage API calls recorded in `file` instead of connecting to a VSD")
+	)
+
+	flag.Parse()
+
+	if *readonlyflag {
+		readonly, readonlylocked = true, true
+	}
+
+	// First we set the connection details
+
+	if *certflag != "" {
+		certfname = *certflag
+	}
+	if *keyflag != "" {
+		keyfname = *keyflag
+	}
+	saveprofiledefaults()
+
+	if *profileflag != "" {
+		if err := loadprofile(*profileflag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
-		return "Error", err
 	}
 
-	switch loglevel {
-	case "Debug":
-		log.SetLevel(log.DebugLevel)
-		return "Debug level now set to: " + loglevel, nil
-	case "Info":
-		log.SetLevel(log.InfoLevel)
-		return "Debug level now set to: " + loglevel, nil
-	default:
-		log.SetLevel(log.InfoLevel)
-		return "Debug level now set to Info", nil
+	if *levelflag != "" && !setloglevel(*levelflag) {
+		fmt.Fprintln(os.Stderr, "Invalid log level:", *levelflag)
+		os.Exit(1)
+	}
+	if *logfileflag != "" {
+		if _, err := setlogfile(*logfileflag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *logjsonflag {
+		setlogformat("json")
 	}
-}
 
-func main() {
+	if *replayflag != "" {
+		if err := startreplay(*replayflag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 
-	// First we set the connection details
+	if *traceflag {
+		args := []string{"on"}
+		if *tracefflag != "" {
+			args = append(args, *tracefflag)
+		}
+		if _, err := settrace(args...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
 
 	// create new shell.
 	// by default, new shell includes 'exit', 'help' and 'clear' commands.
 
-	shell := ishell.New()
+	shell = ishell.New()
 
 	shell.Println("Nuage VSD API Interactive Shell")
 
-	shell.Register("greet", mygreet)
+	// Persistent command history. Ctrl-R searches through it
+	shell.SetHistoryPath(historypath())
+
+	register("greet", mygreet)
+
+	register("debuglevel", debuglevel)
 
-	shell.Register("debuglevel", debuglevel)
+	register("logfile", setlogfile)
+
+	register("logformat", setlogformat)
 
 	// API connection handling
 
-	shell.Register("setconn", setconn)
+	register("setconn", setconn)
+
+	register("makeconn", makeconn)
+
+	register("setcertconn", setcertconn)
+
+	register("makecertconn", makecertconn)
+
+	register("displayconn", displayconn)
+
+	register("resetconn", resetconn)
+
+	register("tls", settls)
+
+	register("keepalive", setkeepalive)
+
+	register("output", setoutput)
+
+	register("trace", settrace)
+
+	register("record", record)
+
+	register("fetch", setfetch)
+
+	register("timeout", settimeout)
+
+	register("cache", setcache)
+
+	register("profile", selectprofile)
+
+	register("readonly", setreadonly)
+
+	// Audit log of mutating operations -- see "audit.go"
+	register("audit", audit)
+
+	//// Top-level CRUD operations. Arguments may refer to shell variables and to objects returned by the last GET
+	register("GET", Get)
+
+	register("FIND", Find)
+
+	register("SHOW", Show)
+	register("ALLOC", Alloc)
+
+	register("DESCRIBE", Describe)
+
+	register("LINT", Lint)
+
+	register("REPORT", Report)
+
+	register("CREATE", mutating("CREATE", Create))
+	register("ATTACH", mutating("ATTACH", Attach))
+	register("DETACH", mutating("DETACH", Detach))
+
+	register("DELETE", mutating("DELETE", Delete))
 
-	shell.Register("makeconn", makeconn)
+	register("UNDO", mutating("UNDO", Undo))
 
-	shell.Register("makecertconn", makecertconn)
+	register("results", showresults)
 
-	shell.Register("displayconn", displayconn)
+	// Shell variables, aliases and loops -- see "script.go"
 
-	shell.Register("resetconn", resetconn)
+	register("set", setvar)
 
-	//// Top-level CRUD operations
-	shell.Register("GET", Get)
+	register("unset", unsetvar)
 
-	shell.Register("CREATE", Create)
+	registerverbatim("alias", alias)
 
-	shell.Register("DELETE", Delete)
+	registerverbatim("unalias", unalias)
+
+	registerverbatim("foreach", foreach)
+
+	// Replaying a recording: Connect right away
+	if replaying != nil {
+		out, err := commands["makeconn"]()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		shell.Println(out + " -- replaying " + replaying.fname)
+	}
 
 	// start shell
 	shell.Start()
@@ -255,12 +519,8 @@ func Create(args ...string) (string, error) {
 		return "Not Connected to a VSD server", nil
 	}
 
-	// 1 argument:  <entity>
-	// 2 arguments: <entity> <ID>
-	// 3 arguments: <entity> <ID> <children>
-
-	if len(args) < 1 || len(args) > 3 {
-		return "CREATE <entity> [ <ID> [ <children> ] ]  ", nil
+	if len(args) < 1 {
+		return "Format: CREATE Policy <filename> <DomainID> | CREATE vm | container <Name> ... ", nil
 	}
 
 	entity := args[0]
@@ -288,11 +548,24 @@ func Create(args ...string) (string, error) {
 			// Cast VSPK Domain to netpolicy Domain
 			pd := netpolicy.PolicyDomain(*domain)
 
+			rec, err := newaudit("CREATE", args, "Policy", domain.ID)
+			if err != nil {
+				return "", err
+			}
+
+			// Record any policy with the same name that is being replaced
+			if p, err := pd.GetPolicyByName(npr.Name); err == nil {
+				rec.before(p)
+			}
+			rec.after(npr)
+
 			// Apply Policy
 
 			if err := pd.ApplyPolicy(&npr); err != nil {
+				rec.done(err)
 				return "", err
 			} else {
+				rec.done(nil)
 				fmt.Printf("\n\n====> Applied Policy: %#s <======\n%s\n\n", npr.Name, npr)
 			}
 		default:
@@ -302,6 +575,9 @@ func Create(args ...string) (string, error) {
 
 		return "CREATE Policy -- done ", nil
 
+	case "vm", "container":
+		return createvm(entity, args[1:])
+
 	default:
 		// Unknown entity request
 		break
@@ -319,8 +595,31 @@ func Get(args ...string) (string, error) {
 	// 2 arguments: <entity> <ID>
 	// 3 arguments: <entity> <ID> <children>
 
+	// GET ... --ids : Only print the IDs of the objects returned
+	if n := len(args); n > 0 && args[n-1] == "--ids" {
+		var (
+			out string
+			err error
+		)
+
+		results = nil
+		silently(func() {
+			out, err = Get(args[:n-1]...)
+		})
+
+		if err != nil || len(results) == 0 {
+			return out, err
+		}
+
+		for _, obj := range results {
+			id, _ := attribute(obj, "ID")
+			fmt.Println(id)
+		}
+		return "", nil
+	}
+
 	if len(args) < 1 || len(args) > 3 {
-		return "GET <entity> [ <ID> [ <children> ] ]  ", nil
+		return "GET <entity> [ <ID> [ <children> ] ] [ --ids ]", nil
 	}
 
 	entity := args[0]
@@ -380,10 +679,11 @@ func Get(args ...string) (string, error) {
 		acls, err := root.IngressACLTemplates(&bambou.FetchingInfo{})
 
 		if err != nil {
-			fmt.Printf("GET IngressACLTemplates failed: ")
 			return "", err
 		}
 
+		keep(acls)
+
 		for i, v := range acls {
 			acl, _ := json.MarshalIndent(*v, "", "\t")
 			fmt.Printf("\n ===> Ingress ACL Template nr [%d]: ID [%s], Name [%s] <=== \n%#s\n", i, acls[i].ID, acls[i].Name, string(acl))
@@ -395,10 +695,11 @@ func Get(args ...string) (string, error) {
 		acles, err := root.IngressACLEntryTemplates(&bambou.FetchingInfo{})
 
 		if err != nil {
-			fmt.Printf("GET IngressACLEntryTemplates failed: ")
 			return "", err
 		}
 
+		keep(acles)
+
 		for i, v := range acles {
 			acle, _ := json.MarshalIndent(*v, "", "\t")
 			fmt.Printf("\n ===> Ingress ACL Entry Template nr [%d]: Description [%s],  ID [%s]  <=== \n%#s\n", i, acles[i].Description, acles[i].ID, string(acle))
@@ -410,10 +711,11 @@ func Get(args ...string) (string, error) {
 		containerlist, err := root.Containers(&bambou.FetchingInfo{})
 
 		if err != nil {
-			fmt.Printf("GET containers failed: ")
 			return "", err
 		}
 
+		keep(containerlist)
+
 		for i, v := range containerlist {
 			container, _ := json.MarshalIndent(*v, "", "\t")
 			fmt.Printf("\n ===> Container nr [%d]: Name [%s] <=== \n%#s\n", i, containerlist[i].Name, string(container))
@@ -428,10 +730,11 @@ func Get(args ...string) (string, error) {
 			orglist, err := root.Enterprises(&bambou.FetchingInfo{})
 
 			if err != nil {
-				fmt.Printf("GET enterprises failed: ")
 				return "", err
 			}
 
+			keep(orglist)
+
 			for i, v := range orglist {
 				org, _ := json.MarshalIndent(*v, "", "\t")
 				fmt.Printf("\n ===> Org nr [%d]: Name [%s] <=== \n%#s\n", i, orglist[i].Name, string(org))
@@ -446,10 +749,11 @@ func Get(args ...string) (string, error) {
 			err := org.Fetch()
 
 			if err != nil {
-				fmt.Printf("GET enterprise ID [%s] failed: ", org.ID)
 				return "", err
 			}
 
+			keep(org)
+
 			// JSON pretty-print the org
 			jsonorg, _ := json.MarshalIndent(org, "", "\t")
 			fmt.Printf("\n\n ===> Org: Name [%s] <=== \n%#s\n", org.Name, string(jsonorg))
@@ -468,9 +772,11 @@ func Get(args ...string) (string, error) {
 				dtl, err := org.DomainTemplates(&bambou.FetchingInfo{})
 
 				if err != nil {
-					fmt.Printf("GET enterprise [%s] domaintemplates failed: ", org.ID)
 					return "", err
 				}
+
+				keep(dtl)
+
 				// Iterate through the list of domain templates and JSON pretty-print them
 				fmt.Printf("\n ######## Domain templates for Enterprise ID: [%s] ########\n", org.ID)
 				for i, v := range dtl {
@@ -486,10 +792,11 @@ func Get(args ...string) (string, error) {
 				dl, err := org.Domains(&bambou.FetchingInfo{})
 
 				if err != nil {
-					fmt.Printf("GET enterprise [%s] domains failed: ", org.ID)
 					return "", err
 				}
 
+				keep(dl)
+
 				// Iterate through the list of domains and JSON pretty-print them
 				fmt.Printf("\n ######## Domains for Enterprise ID: [%s] ########\n", org.ID)
 				for i, v := range dl {
@@ -504,10 +811,11 @@ func Get(args ...string) (string, error) {
 				dl, err := org.L2Domains(&bambou.FetchingInfo{})
 
 				if err != nil {
-					fmt.Printf("GET enterprise [%s] L2domains failed: ", org.ID)
 					return "", err
 				}
 
+				keep(dl)
+
 				// Iterate through the list of domains and JSON pretty-print them
 				fmt.Printf("\n ######## Domains for Enterprise ID: [%s] ########\n", org.ID)
 				for i, v := range dl {
@@ -522,10 +830,11 @@ func Get(args ...string) (string, error) {
 				dl, err := org.VMs(&bambou.FetchingInfo{})
 
 				if err != nil {
-					fmt.Printf("GET enterprise [%s] vms failed: ", org.ID)
 					return "", err
 				}
 
+				keep(dl)
+
 				// Iterate through the list of vms and JSON pretty-print them
 				fmt.Printf("\n ######## Vms for Enterprise ID: [%s] ########\n", org.ID)
 				for i, v := range dl {
@@ -540,10 +849,11 @@ func Get(args ...string) (string, error) {
 				dl, err := org.Containers(&bambou.FetchingInfo{})
 
 				if err != nil {
-					fmt.Printf("GET enterprise [%s] containers failed: ", org.ID)
 					return "", err
 				}
 
+				keep(dl)
+
 				// Iterate through the list of containers and JSON pretty-print them
 				fmt.Printf("\n ######## Containers for Enterprise ID: [%s] ########\n", org.ID)
 				for i, v := range dl {
@@ -562,10 +872,11 @@ func Get(args ...string) (string, error) {
 			err := dt.Fetch()
 
 			if err != nil {
-				fmt.Printf("GET domaintemplates ID [%s] failed. Error: ", dt.ID)
 				return "", err
 			}
 
+			keep(dt)
+
 			// JSON pretty-print the domain template
 			jsondt, _ := json.MarshalIndent(dt, "", "\t")
 			fmt.Printf("\n ===> Domain Template: Name [%s] <=== \n%#s\n", dt.Name, string(jsondt))
@@ -582,10 +893,11 @@ func Get(args ...string) (string, error) {
 				ztl, err := dt.ZoneTemplates(&bambou.FetchingInfo{})
 
 				if err != nil {
-					fmt.Printf("GET domaintemplates ID [%s] zonetemplates failed. Error: ", dt.ID)
 					return "", err
 				}
 
+				keep(ztl)
+
 				// Iterate through the list of zone templates and JSON pretty-print them
 				fmt.Printf("\n ######## Zone templates for Domain template ID: [%s] ########\n", dt.ID)
 				for i, v := range ztl {
@@ -603,10 +915,11 @@ func Get(args ...string) (string, error) {
 			dl, err := root.Domains(&bambou.FetchingInfo{})
 
 			if err != nil {
-				fmt.Printf("GET domains failed: ")
 				return "", err
 			}
 
+			keep(dl)
+
 			for i, v := range dl {
 				jsondomain, _ := json.MarshalIndent(v, "", "\t")
 				fmt.Printf("\n ===> Domain nr [%d]: Name [%s] <=== \n%#s\n", i, dl[i].Name, string(jsondomain))
@@ -621,6 +934,8 @@ func Get(args ...string) (string, error) {
 				return "", err
 			}
 
+			keep(domain)
+
 			jsondomain, _ := json.MarshalIndent(domain, "", "\t")
 			fmt.Printf("\n ===> Domain Name [%s] <=== \n%#s\n", domain.Name, string(jsondomain))
 			return "Domain Get -- done", nil
@@ -638,6 +953,8 @@ func Get(args ...string) (string, error) {
 					return "", err
 				}
 
+				keep(vports)
+
 				for i, v := range vports {
 					jsonvport, _ := json.MarshalIndent(v, "", "\t")
 					fmt.Printf("\n ===> VPort nr [%d]: Name [%s] <=== \n%#s\n", i, vports[i].Name, string(jsonvport))
@@ -651,6 +968,8 @@ func Get(args ...string) (string, error) {
 					return "", err
 				}
 
+				keep(vmiflist)
+
 				for i, v := range vmiflist {
 					jsonvmif, _ := json.MarshalIndent(v, "", "\t")
 					fmt.Printf("\n ===> VMInterface nr [%d]: Name [%s] <=== \n%#s\n", i, vmiflist[i].Name, string(jsonvmif))
@@ -665,10 +984,11 @@ func Get(args ...string) (string, error) {
 			zl, err := root.Zones(&bambou.FetchingInfo{})
 
 			if err != nil {
-				fmt.Printf("GET zones failed: ")
 				return "", err
 			}
 
+			keep(zl)
+
 			for i, v := range zl {
 				jsonzone, _ := json.MarshalIndent(v, "", "\t")
 				fmt.Printf("\n ===> Zone nr [%d]: Name [%s] <=== \n%#s\n", i, zl[i].Name, string(jsonzone))
@@ -687,6 +1007,8 @@ func Get(args ...string) (string, error) {
 				return "", err
 			}
 
+			keep(zone)
+
 			jsonzone, _ := json.MarshalIndent(zone, "", "\t")
 			fmt.Printf("\n ===> Zone Name [%s] <=== \n%#s\n", zone.Name, string(jsonzone))
 			return "Zone Get -- done", nil
@@ -700,10 +1022,11 @@ func Get(args ...string) (string, error) {
 			subnetlist, err := root.Subnets(&bambou.FetchingInfo{})
 
 			if err != nil {
-				fmt.Printf("GET subnets failed: ")
 				return "", err
 			}
 
+			keep(subnetlist)
+
 			for i, v := range subnetlist {
 				jsonsubnet, _ := json.MarshalIndent(v, "", "\t")
 				fmt.Printf("\n ===> Subnet nr [%d]: Name [%s] <=== \n%#s\n", i, subnetlist[i].Name, string(jsonsubnet))
@@ -721,6 +1044,8 @@ func Get(args ...string) (string, error) {
 				return "", err
 			}
 
+			keep(subnet)
+
 			jsonsubnet, _ := json.MarshalIndent(subnet, "", "\t")
 			fmt.Printf("\n ===> Subnet Name [%s] <=== \n%#s\n", subnet.Name, string(jsonsubnet))
 			return "Subnet Get -- done", err
@@ -737,6 +1062,8 @@ func Get(args ...string) (string, error) {
 					return "", err
 				}
 
+				keep(vports)
+
 				for i, v := range vports {
 					jsonvport, _ := json.MarshalIndent(v, "", "\t")
 					fmt.Printf("\n ===> VPort nr [%d]: Name [%s] <=== \n%#s\n", i, vports[i].Name, string(jsonvport))
@@ -751,6 +1078,8 @@ func Get(args ...string) (string, error) {
 					return "", err
 				}
 
+				keep(vmiflist)
+
 				for i, v := range vmiflist {
 					jsonvmi, _ := json.MarshalIndent(v, "", "\t")
 					fmt.Printf("\n ===> VMInterface nr [%d]: Name [%s] <=== \n%#s\n", i, vmiflist[i].Name, string(jsonvmi))
@@ -765,10 +1094,11 @@ func Get(args ...string) (string, error) {
 			vmlist, err := root.VMs(&bambou.FetchingInfo{})
 
 			if err != nil {
-				fmt.Printf("GET vms failed: ")
 				return "", err
 			}
 
+			keep(vmlist)
+
 			for i, v := range vmlist {
 				jsonvm, _ := json.MarshalIndent(v, "", "\t")
 				fmt.Printf("\n ===> VirtualMachine nr [%d]: Name [%s] <=== \n%#s\n", i, vmlist[i].Name, string(jsonvm))
@@ -785,6 +1115,8 @@ func Get(args ...string) (string, error) {
 				return "", err
 			}
 
+			keep(vm)
+
 			jsonvm, _ := json.MarshalIndent(vm, "", "\t")
 			fmt.Printf("\n ===> VirtualMachine Name [%s] <=== \n%#s\n", vm.Name, string(jsonvm))
 			return "Virtual Machine Get -- done", nil
@@ -797,103 +1129,117 @@ func Get(args ...string) (string, error) {
 	return "Don't know how to GET Nuage API entity: " + strings.Join(args, " "), nil
 }
 
-func Delete(args ...string) (string, error) {
-	if root == nil {
-		return "Not Connected", nil
-	}
-	// Format: <entity> <ID>
-	if len(args) != 2 {
-		return "Format:\n    DELETE <entity> <ID>", nil
-	}
-	entity := args[0]
-	id := args[1]
+// VSD API objects, as far as the shell commands operating on a single object are concerned
+type vsdobject interface {
+	Fetch() *bambou.Error
+	Delete() *bambou.Error
+}
 
+// Instantiate a VSD API object given its (singular) entity name and ID. Returns nil for unknown entities
+func newobject(entity, id string) vsdobject {
 	switch entity {
-	case "enterprise": // DELETE enterprise <ID>
+	case "enterprise":
 		obj := new(vspk.Enterprise)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE enterprise ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "domaintemplate": // DELETE domaintemplate <ID>
+		return obj
+	case "domaintemplate":
 		obj := new(vspk.DomainTemplate)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE domaintemplate ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "domain": // DELETE domain <ID>
+		return obj
+	case "domain":
 		obj := new(vspk.Domain)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE domain ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-
-	case "zonetemplate": // DELETE zonetemplate <ID>
+		return obj
+	case "zonetemplate":
 		obj := new(vspk.ZoneTemplate)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE zonetemplate ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "zone": // DELETE zone <ID>
+		return obj
+	case "zone":
 		obj := new(vspk.Zone)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE zone ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "subnet": // DELETE subnet <ID>
+		return obj
+	case "subnet":
 		obj := new(vspk.Subnet)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE subnet ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "vport": // DELETE vport <ID>
+		return obj
+	case "vport":
 		obj := new(vspk.VPort)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE vport ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "vminterface": // DELETE vminterface <ID>
+		return obj
+	case "vminterface":
 		obj := new(vspk.VMInterface)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE vminterface ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "vm": // DELETE vm <ID>
+		return obj
+	case "containerinterface":
+		obj := new(vspk.ContainerInterface)
+		obj.ID = id
+		return obj
+	case "vm":
 		obj := new(vspk.VM)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE vm ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
-	case "container": // DELETE container <ID>
+		return obj
+	case "container":
 		obj := new(vspk.Container)
 		obj.ID = id
-		err := obj.Delete()
-		if err != nil {
-			fmt.Printf("DELETE container ID [%s] failed. Error: ", obj.ID)
-			return "", err
-		}
+		return obj
+	case "ingressaclentrytemplate":
+		obj := new(vspk.IngressACLEntryTemplate)
+		obj.ID = id
+		return obj
+	case "egressaclentrytemplate":
+		obj := new(vspk.EgressACLEntryTemplate)
+		obj.ID = id
+		return obj
+	}
+	return nil
+}
 
-	default:
+func Delete(args ...string) (string, error) {
+	if root == nil {
+		return "Not Connected", nil
+	}
+	// Format: <entity> <ID> [ --subtree ]
+	if len(args) != 2 && (len(args) != 3 || args[2] != "--subtree") {
+		return "Format:\n    DELETE <entity> <ID> [ --subtree ]", nil
+	}
+	entity := args[0]
+	id := args[1]
+
+	obj := newobject(entity, id)
+	if obj == nil {
 		return "Don't know how to DELETE entity: " + entity, nil
 	}
+
+	rec, err := newaudit("DELETE", args, entity, id)
+	if err != nil {
+		return "", err
+	}
+
+	// Record the object as it was before deleting it, and stash it (with "--subtree": together with its subtree) for UNDO
+	var saved *stash
+	if err := obj.Fetch(); err == nil {
+		rec.before(obj)
+
+		saved = &stash{entity: entity, obj: obj}
+		if len(args) == 3 {
+			if err := saved.fetchchildren(cmdctx); err != nil {
+				rec.done(err)
+				return "DELETE cancelled -- " + entity + " ID [" + id + "] not deleted", nil
+			}
+		}
+	}
+
+	if err := obj.Delete(); err != nil {
+		rec.done(err)
+		return "", err
+	}
+
+	rec.done(nil)
+
+	lastdeleted = saved
+	if saved == nil {
+		return "Could not fetch " + entity + " ID [" + id + "] before deleting it -- UNDO not available", nil
+	}
 	return "", nil
 }
 
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Mock VSD: A fake Nuage API server, for development, demos and CI without a VSD.
+//
+//	nuage-vsd-shell mock-server --fixtures <dir> [--listen <address>] [--api-version <version>]
+//
+// Serves plain HTTP. The fixtures directory holds one JSON file per entity type, named after its REST name (e.g.
+// "enterprises.json", "domains.json"), each a list of objects with their VSD attributes -- "ID", "parentID",
+// "parentType", "name" ...  "me.json", if present, holds the user the shell logs in as; if it has a "password", logins
+// are checked against it. Changes are kept in memory only.
+//
+// Supported: GET /nuage (API versions), GET /me (login), GET / PUT / DELETE /<entities>/<ID>, GET / POST
+// /<parent entities>/<parent ID>/<entities> and top-level GET / POST /<entities>. Filters ("X-Nuage-Filter") of the form
+// <attribute> == "<value>" and <attribute> BEGINSWITH "<value>" are honoured. Creating a VM or container creates its interfaces.
+
+// Mock VSD objects are plain JSON objects
+type mockobject map[string]interface{}
+
+type mockvsd struct {
+	sync.Mutex
+
+	version string
+	me      mockobject
+
+	// Entity type (REST name) => ID => object
+	objects map[string]map[string]mockobject
+}
+
+var (
+	mockpath   = regexp.MustCompile(`^/nuage/api/(v[0-9_]+)/(.*)$`)
+	mockfilter = regexp.MustCompile(`^\s*(\w+)\s*(==|BEGINSWITH)\s*(?:"([^"]*)"|'([^']*)')\s*$`)
+)
+
+// "domains" => "domain", as used in "parentType"
+func singular(restname string) string {
+	return strings.TrimSuffix(restname, "s")
+}
+
+func mockid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (o mockobject) str(name string) string {
+	s, _ := o[name].(string)
+	return s
+}
+
+// ID of the parent of a type an object refers to: Its "<parent type>ID" attribute -- in any case, e.g. "VPortID"
+func (o mockobject) ref(parenttype string) string {
+	for k, v := range o {
+		if strings.EqualFold(k, parenttype+"ID") {
+			s, _ := v.(string)
+			return s
+		}
+	}
+	return ""
+}
+
+// Load the fixtures from a directory
+func loadfixtures(dir, version string) (*mockvsd, error) {
+	m := &mockvsd{
+		version: version,
+		objects: make(map[string]map[string]mockobject),
+		me: mockobject{
+			"ID":             mockid(),
+			"userName":       "csproot",
+			"enterpriseName": "csp",
+		},
+	}
+	for name := range entities {
+		m.objects[name] = make(map[string]mockobject)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No fixtures (*.json) in %s", dir)
+	}
+
+	for _, fname := range files {
+		name := strings.TrimSuffix(filepath.Base(fname), ".json")
+
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+
+		if name == "me" {
+			if err := json.Unmarshal(data, &m.me); err != nil {
+				return nil, fmt.Errorf("%s: %s", fname, err)
+			}
+			continue
+		}
+
+		if _, ok := m.objects[name]; !ok {
+			return nil, fmt.Errorf("%s: Unknown entity type [%s]", fname, name)
+		}
+
+		var objs []mockobject
+		if err := json.Unmarshal(data, &objs); err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+
+		for _, o := range objs {
+			if o.str("ID") == "" {
+				o["ID"] = mockid()
+			}
+			m.objects[name][o.str("ID")] = o
+		}
+	}
+
+	if m.me.str("ID") == "" {
+		m.me["ID"] = mockid()
+	}
+
+	// Top-level objects without a parent belong to the user
+	for _, objs := range m.objects {
+		for _, o := range objs {
+			if o.str("parentID") == "" {
+				o["parentID"], o["parentType"] = m.me.str("ID"), "me"
+			}
+		}
+	}
+	return m, nil
+}
+
+// Children of an object, of a given type. As with VSD, the top-level collections hold all objects of their type, and
+// objects are also listed under the parents their "<parent type>ID" attributes refer to -- e.g. VMs under their
+// enterprise -- and under their ancestors -- e.g. subnets and vports under their domain
+func (m *mockvsd) children(parenttype, parentid, name string) []mockobject {
+	var children []mockobject
+	for _, o := range m.objects[name] {
+		if parenttype == "me" || o.ref(parenttype) == parentid || m.descends(o, parentid) {
+			children = append(children, o)
+		}
+	}
+	return children
+}
+
+// Whether an object is below another one, by ID
+func (m *mockvsd) descends(o mockobject, ancestorid string) bool {
+	for depth := 0; o != nil && depth < 16; depth++ {
+		if o.str("parentID") == ancestorid {
+			return true
+		}
+		o = m.byid(o.str("parentID"))
+	}
+	return false
+}
+
+// Object by ID, of any type
+func (m *mockvsd) byid(id string) mockobject {
+	if id == "" {
+		return nil
+	}
+	for _, objs := range m.objects {
+		if o, ok := objs[id]; ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// Delete an object and all its descendants -- and the interfaces attached to a vport
+func (m *mockvsd) remove(name, id string) {
+	delete(m.objects[name], id)
+
+	for child, objs := range m.objects {
+		for cid, o := range objs {
+			if o.str("parentID") == id || (name == "vports" && strings.HasSuffix(child, "interfaces") && o.ref("vport") == id) {
+				m.remove(child, cid)
+			}
+		}
+	}
+}
+
+// Reply with a list of objects -- the Nuage API always returns lists
+func mockreply(w http.ResponseWriter, status int, objs ...mockobject) {
+	if objs == nil {
+		objs = []mockobject{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Nuage-Count", strconv.Itoa(len(objs)))
+	w.Header().Set("X-Nuage-Page", "0")
+	w.Header().Set("X-Nuage-PageSize", strconv.Itoa(len(objs)))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(objs)
+}
+
+// Reply with a VSD error
+func mockerror(w http.ResponseWriter, status, code int, property, title, description string) {
+	reply := mockobject{
+		"errors": []mockobject{{
+			"property":     property,
+			"descriptions": []mockobject{{"title": title, "description": description}},
+		}},
+		"title":       title,
+		"description": description,
+	}
+	if code != 0 {
+		reply["internalErrorCode"] = code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(reply)
+}
+
+// Apply "X-Nuage-Filter" to a list of objects, and sort it by ID so that listings are stable
+func mockfiltered(r *http.Request, objs []mockobject) []mockobject {
+	sort.Slice(objs, func(i, j int) bool { return objs[i].str("ID") < objs[j].str("ID") })
+
+	filter := r.Header.Get("X-Nuage-Filter")
+	if filter == "" {
+		return objs
+	}
+
+	f := mockfilter.FindStringSubmatch(filter)
+	if f == nil {
+		return objs
+	}
+	value := f[3] + f[4]
+
+	var filtered []mockobject
+	for _, o := range objs {
+		for attr, v := range o {
+			if strings.EqualFold(attr, f[1]) && (fmt.Sprint(v) == value || (f[2] == "BEGINSWITH" && strings.HasPrefix(fmt.Sprint(v), value))) {
+				filtered = append(filtered, o)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+func (m *mockvsd) authorized(r *http.Request, login bool) bool {
+	_, user, password, ok := credentials(r)
+	if !ok {
+		return false
+	}
+
+	if m.me.str("APIKey") != "" && password == m.me.str("APIKey") && user == m.me.str("userName") {
+		return true
+	}
+	if !login {
+		return false
+	}
+	return m.me.str("password") == "" || (password == m.me.str("password") && user == m.me.str("userName"))
+}
+
+// GET /me: Log in, returning a new API key
+func (m *mockvsd) login(w http.ResponseWriter, r *http.Request) {
+	if !m.authorized(r, true) {
+		mockerror(w, http.StatusUnauthorized, 0, "", "Unauthorized", "Invalid credentials")
+		return
+	}
+
+	_, user, _, _ := credentials(r)
+	me := mockobject{}
+	for k, v := range m.me {
+		if k != "password" {
+			me[k] = v
+		}
+	}
+
+	if r.Header.Get("X-Nuage-Organization") != "" {
+		me["enterpriseName"] = r.Header.Get("X-Nuage-Organization")
+	}
+	me["userName"] = user
+	me["APIKey"] = mockid()
+	me["APIKeyExpiry"] = time.Now().Add(24*time.Hour).UnixNano() / int64(time.Millisecond)
+
+	// Subsequent calls authenticate with the API key
+	m.me["userName"], m.me["APIKey"] = user, me["APIKey"]
+	mockreply(w, http.StatusOK, me)
+}
+
+func (m *mockvsd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+
+	log.WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}).Info("Mock VSD")
+
+	if r.URL.Path == "/nuage" {
+		// Reported as e.g. "v4.0"
+		v := "v" + strings.Replace(strings.TrimPrefix(m.version, "v"), "_", ".", 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"versions": [{"version": %q, "status": "CURRENT"}]}`, v)
+		return
+	}
+
+	match := mockpath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		mockerror(w, http.StatusNotFound, 0, "", "Not found", r.URL.Path)
+		return
+	}
+	if match[1] != m.version {
+		mockerror(w, http.StatusNotFound, 0, "", "Unsupported API version", "Mock VSD serves Nuage API "+m.version)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(match[2], "/"), "/")
+
+	if parts[0] == "me" && len(parts) == 1 && r.Method == "GET" {
+		m.login(w, r)
+		return
+	}
+	if !m.authorized(r, false) {
+		mockerror(w, http.StatusUnauthorized, 0, "", "Unauthorized", "Invalid or expired API key")
+		return
+	}
+
+	switch len(parts) {
+	case 1: // /<entities>, at the top level
+		m.collection(w, r, "me", m.me.str("ID"), parts[0])
+	case 2: // /<entities>/<ID>
+		m.object(w, r, parts[0], parts[1])
+	case 3: // /<parent entities>/<parent ID>/<entities>
+		if _, ok := m.objects[parts[0]]; !ok && parts[0] != "me" {
+			mockerror(w, http.StatusNotFound, 0, "", "Not found", "Unknown entity type "+parts[0])
+			return
+		}
+		parent := m.me
+		if parts[0] != "me" {
+			parent = m.objects[parts[0]][parts[1]]
+		}
+		if parent == nil || parent.str("ID") != parts[1] {
+			mockerror(w, http.StatusNotFound, 0, "", "Not found", "No "+singular(parts[0])+" with ID "+parts[1])
+			return
+		}
+		m.collection(w, r, singular(parts[0]), parts[1], parts[2])
+	default:
+		mockerror(w, http.StatusNotFound, 0, "", "Not found", r.URL.Path)
+	}
+}
+
+// GET / POST a collection of objects under a parent
+func (m *mockvsd) collection(w http.ResponseWriter, r *http.Request, parenttype, parentid, name string) {
+	if _, ok := m.objects[name]; !ok {
+		mockerror(w, http.StatusNotFound, 0, "", "Not found", "Unknown entity type "+name)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		mockreply(w, http.StatusOK, mockfiltered(r, m.children(parenttype, parentid, name))...)
+
+	case "POST":
+		o := mockobject{}
+		if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+			mockerror(w, http.StatusBadRequest, 0, "", "Invalid JSON", err.Error())
+			return
+		}
+
+		if n := o.str("name"); n != "" {
+			for _, sibling := range m.children(parenttype, parentid, name) {
+				if sibling.str("name") == n {
+					mockerror(w, http.StatusConflict, 2510, "name", "Duplicate name", "Another "+singular(name)+" with the same name exists")
+					return
+				}
+			}
+		}
+
+		// As with VSD, interfaces are attached to the network of their vport, and those of a VM / container are created
+		// together with it
+		var intfs []mockobject
+		switch name {
+		case "vminterfaces", "containerinterfaces":
+			intfs = []mockobject{o}
+		case "vms", "containers":
+			list, _ := o["interfaces"].([]interface{})
+			for _, i := range list {
+				attrs, _ := i.(map[string]interface{})
+				intfs = append(intfs, mockobject(attrs))
+			}
+		}
+		for _, intf := range intfs {
+			vp, ok := m.objects["vports"][intf.str("VPortID")]
+			if !ok {
+				mockerror(w, http.StatusConflict, 0, "VPortID", "Invalid vport", "No vport with ID "+intf.str("VPortID"))
+				return
+			}
+			intf["VPortName"], intf["domainID"] = vp.str("name"), vp.str("domainID")
+			intf["attachedNetworkID"], intf["attachedNetworkType"] = vp.str("parentID"), strings.ToUpper(vp.str("parentType"))
+		}
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		o["ID"], o["parentID"], o["parentType"] = mockid(), parentid, parenttype
+		o["creationDate"], o["lastUpdatedDate"] = now, now
+		m.objects[name][o.str("ID")] = o
+
+		// As with VSD, vports in a subnet refer to its zone and domain
+		if name == "vports" && parenttype == "subnet" {
+			if zone, ok := m.objects["zones"][m.objects["subnets"][parentid].str("parentID")]; ok {
+				o["zoneID"], o["domainID"] = zone.str("ID"), zone.str("parentID")
+			}
+		}
+
+		if name == "vms" || name == "containers" {
+			for _, intf := range intfs {
+				intf["ID"], intf["parentID"], intf["parentType"] = mockid(), o.str("ID"), singular(name)
+				intf["creationDate"], intf["lastUpdatedDate"] = now, now
+				m.objects[singular(name)+"interfaces"][intf.str("ID")] = intf
+			}
+		}
+		mockreply(w, http.StatusCreated, o)
+
+	default:
+		mockerror(w, http.StatusMethodNotAllowed, 0, "", "Method not allowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+// GET / PUT / DELETE an object
+func (m *mockvsd) object(w http.ResponseWriter, r *http.Request, name, id string) {
+	o, ok := m.objects[name][id]
+	if !ok {
+		mockerror(w, http.StatusNotFound, 0, "", "Not found", "No "+singular(name)+" with ID "+id)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		mockreply(w, http.StatusOK, o)
+
+	case "PUT":
+		update := mockobject{}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			mockerror(w, http.StatusBadRequest, 0, "", "Invalid JSON", err.Error())
+			return
+		}
+		for k, v := range update {
+			// Read-only attributes
+			if k != "ID" && k != "parentID" && k != "parentType" {
+				o[k] = v
+			}
+		}
+		o["lastUpdatedDate"] = time.Now().UnixNano() / int64(time.Millisecond)
+		mockreply(w, http.StatusOK, o)
+
+	case "DELETE":
+		m.remove(name, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		mockerror(w, http.StatusMethodNotAllowed, 0, "", "Method not allowed", r.Method+" "+r.URL.Path)
+	}
+}
+
+// nuage-vsd-shell mock-server ...
+func mockserver(args []string) {
+	flags := flag.NewFlagSet("mock-server", flag.ExitOnError)
+
+	var (
+		fixtures = flags.String("fixtures", "", "Directory with the JSON fixtures: <entities>.json, and me.json")
+		listen   = flags.String("listen", "127.0.0.1:8080", "Listen on `address`")
+		version  = flags.String("api-version", vspkversion, "Nuage API `version` served")
+	)
+	flags.Parse(args)
+
+	if *fixtures == "" {
+		fmt.Fprintln(os.Stderr, "Usage: nuage-vsd-shell mock-server --fixtures <dir> [--listen <address>] [--api-version <version>]")
+		os.Exit(2)
+	}
+
+	v, err := parseapiversion(*version)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	m, err := loadfixtures(*fixtures, v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Mock VSD serving Nuage API %s on http://%s -- connect with \"setconn\" to http://%s\n", v, *listen, *listen)
+	if err := http.ListenAndServe(*listen, m); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// End to end: Shell commands against the mock VSD, on the fixtures in "fixtures"
+
+const (
+	mockorg    = "b5d8e7a0-1b4c-4f7e-9a51-0c3b7f2d9e01"
+	mockdomain = "d1a2b3c4-0000-4000-8000-000000000001"
+	mocksubnet = "f1a2b3c4-0000-4000-8000-000000000001"
+)
+
+// Start a mock VSD and connect to it. The connection, and the audit log, last for the test
+func mockconn(t *testing.T) *mockvsd {
+	t.Helper()
+
+	m, err := loadfixtures("fixtures", vspkversion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(m)
+
+	savedurl, saveduser, savedpasswd, savedorg, savedversion, savedaudit := vsdurl, user, passwd, org, apiversion, auditfname
+	vsdurl, user, passwd, org, apiversion = srv.URL, "csproot", "csproot", "csp", vspkversion
+	auditfname = filepath.Join(t.TempDir(), "audit.log")
+
+	t.Cleanup(func() {
+		resetconn()
+		srv.Close()
+		vsdurl, user, passwd, org, apiversion, auditfname = savedurl, saveduser, savedpasswd, savedorg, savedversion, savedaudit
+		results, lastdeleted = nil, nil
+	})
+
+	if _, err := makeconn(); err != nil || root == nil {
+		t.Fatalf("makeconn to the mock VSD: %v", err)
+	}
+	return m
+}
+
+// Make API calls to a path fail with an HTTP status, as VSD would. Returns a function to stop failing them
+func failing(t *testing.T, path string, status int) func() {
+	t.Helper()
+
+	next := apirelay.next
+	apirelay.next = roundtripper(func(req *http.Request) (*http.Response, error) {
+		if !strings.HasSuffix(req.URL.Path, path) {
+			return next.RoundTrip(req)
+		}
+		body := fmt.Sprintf(`{"title": "Failed", "description": "HTTP %d"}`, status)
+		return &http.Response{StatusCode: status, Status: http.StatusText(status), Request: req,
+			Header: http.Header{"Content-Type": {"application/json"}}, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})
+	restore := func() {
+		if apirelay != nil {
+			apirelay.next = next
+		}
+	}
+	t.Cleanup(restore)
+	return restore
+}
+
+// Number of objects of a type held by the mock VSD
+func (m *mockvsd) count(name string) int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.objects[name])
+}
+
+// Objects of a type held by the mock VSD, with the given attribute value
+func (m *mockvsd) find(name, attr, value string) []mockobject {
+	m.Lock()
+	defer m.Unlock()
+
+	var found []mockobject
+	for _, o := range m.objects[name] {
+		if o.str(attr) == value {
+			found = append(found, o)
+		}
+	}
+	return found
+}
+
+// Number of records in the audit log
+func auditrecords(t *testing.T) int {
+	t.Helper()
+
+	f, err := os.Open(auditfname)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	n := 0
+	for s := bufio.NewScanner(f); s.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestMockGet(t *testing.T) {
+	mockconn(t)
+
+	if _, err := Get("enterprises"); err != nil {
+		t.Fatalf("GET enterprises: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("GET enterprises: %d result(s), want 1", len(results))
+	}
+	if name, _ := attribute(results[0], "name"); name != "ACME" {
+		t.Errorf("GET enterprises: Name [%s], want ACME", name)
+	}
+
+	if _, err := Get("enterprises", mockorg, "domains"); err != nil {
+		t.Fatalf("GET enterprises <ID> domains: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("GET enterprises <ID> domains: %d result(s), want 1", len(results))
+	}
+	if id, _ := attribute(results[0], "ID"); id != mockdomain {
+		t.Errorf("GET enterprises <ID> domains: ID [%s], want %s", id, mockdomain)
+	}
+
+	// Result buffer references, as the shell expands them
+	if _, err := withexpansion(Get)("domains", "$_"); err != nil {
+		t.Fatalf("GET domains $_: %s", err)
+	}
+	if tid, _ := attribute(results[0], "templateID"); tid != "c1a2b3c4-0000-4000-8000-000000000001" {
+		t.Errorf("GET domains <ID>: Template ID [%s]", tid)
+	}
+
+	if _, err := Get("domains", "00000000-0000-4000-8000-000000000000"); err == nil {
+		t.Errorf("GET domains <unknown ID>: No error")
+	}
+}
+
+func TestMockDeleteSubtree(t *testing.T) {
+	m := mockconn(t)
+
+	if _, err := Delete("domain", mockdomain, "--subtree"); err != nil {
+		t.Fatalf("DELETE domain --subtree: %s", err)
+	}
+
+	for _, name := range []string{"domains", "zones", "subnets", "vports"} {
+		if n := m.count(name); n != 0 {
+			t.Errorf("DELETE domain --subtree: %d %s left, want 0", n, name)
+		}
+	}
+	if m.count("enterprises") != 1 || m.count("domaintemplates") != 1 {
+		t.Errorf("DELETE domain --subtree: Deleted more than the domain subtree")
+	}
+	if n := auditrecords(t); n != 1 {
+		t.Errorf("DELETE domain --subtree: %d audit record(s), want 1", n)
+	}
+
+	if lastdeleted == nil || len(lastdeleted.children) != 2 {
+		t.Fatalf("DELETE domain --subtree: Domain and its 2 zones not stashed")
+	}
+
+	// UNDO re-creates the subtree, under new IDs
+	if _, err := Undo(); err != nil {
+		t.Fatalf("UNDO: %s", err)
+	}
+
+	domains := m.find("domains", "name", "ACME-Prod")
+	if len(domains) != 1 || domains[0].str("ID") == mockdomain {
+		t.Fatalf("UNDO: Domain not re-created")
+	}
+	if tid := domains[0].str("templateID"); tid != "c1a2b3c4-0000-4000-8000-000000000001" {
+		t.Errorf("UNDO: Domain template ID [%s], want the original one", tid)
+	}
+	if zones := m.find("zones", "parentID", domains[0].str("ID")); len(zones) != 2 {
+		t.Errorf("UNDO: %d zone(s) re-created, want 2", len(zones))
+	}
+	if n := m.count("subnets"); n != 2 {
+		t.Errorf("UNDO: %d subnet(s) re-created, want 2", n)
+	}
+	if n := m.count("vports"); n != 1 {
+		t.Errorf("UNDO: %d vport(s) re-created, want 1", n)
+	}
+}
+
+func TestMockUndoRetry(t *testing.T) {
+	m := mockconn(t)
+
+	if _, err := Delete("domain", mockdomain, "--subtree"); err != nil {
+		t.Fatalf("DELETE domain --subtree: %s", err)
+	}
+	if n := m.count("vminterfaces"); n != 0 {
+		t.Fatalf("DELETE domain --subtree: %d VM interface(s) left, want 0", n)
+	}
+
+	// Subnets cannot be re-created: The rest is, and the stash kept
+	stop := failing(t, "/subnets", http.StatusForbidden)
+	if _, err := Undo(); err != nil {
+		t.Fatalf("UNDO, subnets failing: %s", err)
+	}
+	if lastdeleted == nil {
+		t.Fatalf("UNDO, subnets failing: Stash dropped")
+	}
+	if n := m.count("domains"); n != 1 {
+		t.Errorf("UNDO, subnets failing: %d domain(s), want 1", n)
+	}
+	if n := m.count("subnets"); n != 0 {
+		t.Errorf("UNDO, subnets failing: %d subnet(s), want 0", n)
+	}
+
+	// Again: Only what is missing is re-created, and the interface attached to the re-created vport
+	stop()
+	out, err := Undo()
+	if err != nil {
+		t.Fatalf("UNDO again: %s", err)
+	}
+	if out != "UNDO -- done, 4 object(s) restored" {
+		t.Errorf("UNDO again: %q, want 2 subnets, 1 vport and 1 interface restored", out)
+	}
+	if lastdeleted != nil {
+		t.Errorf("UNDO again: Stash kept")
+	}
+	for name, want := range map[string]int{"domains": 1, "zones": 2, "subnets": 2, "vports": 1, "vminterfaces": 1} {
+		if n := m.count(name); n != want {
+			t.Errorf("UNDO again: %d %s, want %d", n, name, want)
+		}
+	}
+
+	vports := m.find("vports", "name", "web1-port")
+	intfs := m.find("vminterfaces", "name", "eth0")
+	if len(vports) != 1 || len(intfs) != 1 || intfs[0].str("VPortID") != vports[0].str("ID") {
+		t.Errorf("UNDO again: Interface not attached to the re-created vport")
+	}
+}
+
+func TestMockCreate(t *testing.T) {
+	m := mockconn(t)
+
+	if _, err := Create("vm", "web2", "--create-vports", "mac=fa:16:3e:00:00:02,subnet="+mocksubnet+",ip=10.1.1.20"); err != nil {
+		t.Fatalf("CREATE vm: %s", err)
+	}
+
+	vms := m.find("vms", "name", "web2")
+	if len(vms) != 1 {
+		t.Fatalf("CREATE vm: %d VM(s) named web2, want 1", len(vms))
+	}
+	if vms[0].str("UUID") == "" {
+		t.Errorf("CREATE vm: No UUID")
+	}
+
+	intfs := m.find("vminterfaces", "parentID", vms[0].str("ID"))
+	if len(intfs) != 1 {
+		t.Fatalf("CREATE vm: %d interface(s), want 1", len(intfs))
+	}
+	if intfs[0].str("MAC") != "fa:16:3e:00:00:02" || intfs[0].str("IPAddress") != "10.1.1.20" {
+		t.Errorf("CREATE vm: Interface MAC [%s] IP [%s]", intfs[0].str("MAC"), intfs[0].str("IPAddress"))
+	}
+
+	vports := m.find("vports", "ID", intfs[0].str("VPortID"))
+	if len(vports) != 1 || vports[0].str("parentID") != mocksubnet || vports[0].str("type") != "VM" {
+		t.Fatalf("CREATE vm: Interface not on a VM vport created in subnet %s", mocksubnet)
+	}
+
+	// vport, then VM
+	if n := auditrecords(t); n != 2 {
+		t.Errorf("CREATE vm: %d audit record(s), want 2", n)
+	}
+
+	// Unknown subnet: Nothing left behind
+	if _, err := Create("vm", "web3", "--create-vports", "mac=fa:16:3e:00:00:03,subnet=00000000-0000-4000-8000-000000000000"); err == nil {
+		t.Errorf("CREATE vm in an unknown subnet: No error")
+	}
+	if len(m.find("vms", "name", "web3")) != 0 {
+		t.Errorf("CREATE vm in an unknown subnet: VM created")
+	}
+}
+
+func TestMockReauth(t *testing.T) {
+	m := mockconn(t)
+
+	// Expire the API key: The failed API call is retried after logging in again, and the command succeeds
+	key := sessionkey()
+	m.Lock()
+	m.me["APIKey"] = "expired"
+	m.Unlock()
+
+	zone := "e1a2b3c4-0000-4000-8000-000000000002"
+	if _, err := Delete("zone", zone); err != nil {
+		t.Fatalf("DELETE zone with an expired API key: %s", err)
+	}
+	if root == nil || sessionkey() == key {
+		t.Fatalf("DELETE zone with an expired API key: Not re-authenticated")
+	}
+	if len(m.find("zones", "ID", zone)) != 0 {
+		t.Errorf("DELETE zone with an expired API key: Zone not deleted")
+	}
+	if n := auditrecords(t); n != 1 {
+		t.Errorf("DELETE zone with an expired API key: %d audit record(s), want 1", n)
+	}
+
+	// Concurrent API calls failing alike: All retried with the new API key
+	m.Lock()
+	m.me["APIKey"] = "expired"
+	m.Unlock()
+
+	errs := make(chan *bambou.Error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := root.Enterprises(&bambou.FetchingInfo{})
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Concurrent API calls with an expired API key: %s", err)
+		}
+	}
+
+	// Wrong password: Re-authentication fails, the command fails with HTTP 401 and the connection is reset
+	m.Lock()
+	m.me["APIKey"], m.me["password"] = "expired", "changed"
+	m.Unlock()
+
+	if _, err := withsession(Get)("enterprises"); !unauthorized(err) {
+		t.Errorf("GET enterprises, re-authentication failing: Error %v, want HTTP 401", err)
+	}
+	if root != nil {
+		t.Errorf("GET enterprises, re-authentication failing: Connection not reset")
+	}
+}
+
+func TestMockRecordReplay(t *testing.T) {
+	mockconn(t)
+
+	// Recording started on a live connection: The login is recorded first
+	fname := filepath.Join(t.TempDir(), "session.cassette")
+	if _, err := record("start", fname); err != nil {
+		t.Fatalf("record start: %s", err)
+	}
+	if _, err := Get("enterprises"); err != nil {
+		t.Fatalf("GET enterprises: %s", err)
+	}
+	if _, err := record("stop"); err != nil {
+		t.Fatalf("record stop: %s", err)
+	}
+	resetconn()
+
+	savedurl := vsdurl
+	t.Cleanup(func() { replaying = nil })
+
+	vsdurl = ""
+	if err := startreplay(fname); err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	if vsdurl != savedurl {
+		t.Errorf("Replay: VSD URL [%s], want %s", vsdurl, savedurl)
+	}
+	if _, err := makeconn(); err != nil || root == nil {
+		t.Fatalf("Replay: makeconn: %v", err)
+	}
+	if _, err := Get("enterprises"); err != nil || len(results) != 1 {
+		t.Fatalf("Replay: GET enterprises: %d result(s), %v", len(results), err)
+	}
+	if _, err := Get("domains"); err == nil {
+		t.Errorf("Replay: GET domains, not recorded: No error")
+	}
+}
+
+func TestMockCacheCreate(t *testing.T) {
+	mockconn(t)
+
+	savedttl := cachettl
+	defer func() { cachettl = savedttl; clearcache() }()
+	cachettl = time.Hour
+
+	// Cached before the VM is created, listed afterwards
+	if _, err := Get("domains", mockdomain, "vminterfaces"); err != nil {
+		t.Fatalf("GET domains <ID> vminterfaces: %s", err)
+	}
+	before := len(results)
+
+	if _, err := Create("vm", "web2", "--create-vports", "mac=fa:16:3e:00:00:02,subnet="+mocksubnet); err != nil {
+		t.Fatalf("CREATE vm: %s", err)
+	}
+
+	if _, err := Get("domains", mockdomain, "vminterfaces"); err != nil {
+		t.Fatalf("GET domains <ID> vminterfaces: %s", err)
+	}
+	if len(results) != before+1 {
+		t.Errorf("GET domains <ID> vminterfaces after CREATE vm: %d interface(s), want %d -- stale cache", len(results), before+1)
+	}
+}
+
+func TestMockFind(t *testing.T) {
+	m := mockconn(t)
+
+	// An L2 domain, with a vport and a VM interface on it
+	m.Lock()
+	m.objects["l2domains"]["b1a2b3c4-0000-4000-8000-000000000001"] = mockobject{"ID": "b1a2b3c4-0000-4000-8000-000000000001",
+		"name": "ACME-L2", "address": "192.168.5.0", "netmask": "255.255.255.0", "parentID": mockorg, "parentType": "enterprise"}
+	m.objects["vports"]["b2a2b3c4-0000-4000-8000-000000000001"] = mockobject{"ID": "b2a2b3c4-0000-4000-8000-000000000001",
+		"name": "db1-port", "type": "VM", "parentID": "b1a2b3c4-0000-4000-8000-000000000001", "parentType": "l2domain"}
+	m.Unlock()
+
+	inv, err := crawl(context.Background())
+	if err != nil {
+		t.Fatalf("crawl: %s", err)
+	}
+	if len(inv.failed) != 0 {
+		t.Errorf("crawl: Enterprises failed: %v", inv.failed)
+	}
+
+	matches, _ := inv.find("name", "db1-*")
+	if len(matches) != 1 || matches[0].path != "ACME/ACME-L2/db1-port" {
+		t.Errorf("FIND name db1-*: %d match(es), want the vport in the L2 domain", len(matches))
+	}
+
+	matches, _ = inv.find("ip", "192.168.5.7")
+	if len(matches) != 1 || matches[0].obj.entity != "l2domains" {
+		t.Errorf("FIND ip 192.168.5.7: %d match(es), want the L2 domain", len(matches))
+	}
+
+	matches, _ = inv.find("ip", "10.1.1.10")
+	if len(matches) != 2 {
+		t.Errorf("FIND ip 10.1.1.10: %d match(es), want the interface and its subnet", len(matches))
+	}
+}
+
+func TestMockCreateVPortNames(t *testing.T) {
+	m := mockconn(t)
+
+	// Vports left over with the names the new one would get
+	m.Lock()
+	m.objects["vports"]["a1a2b3c4-0000-4000-8000-000000000099"] = mockobject{"ID": "a1a2b3c4-0000-4000-8000-000000000099",
+		"name": "web2-fa163e000002", "type": "VM", "parentID": mocksubnet, "parentType": "subnet"}
+	m.objects["vports"]["a1a2b3c4-0000-4000-8000-000000000098"] = mockobject{"ID": "a1a2b3c4-0000-4000-8000-000000000098",
+		"name": "web2-fa163e000002-2", "type": "VM", "parentID": mocksubnet, "parentType": "subnet"}
+	m.Unlock()
+
+	if _, err := Create("vm", "web2", "--create-vports", "mac=FA:16:3E:00:00:02,subnet="+mocksubnet,
+		"mac=fa:16:3e:00:00:03,subnet="+mocksubnet); err != nil {
+		t.Fatalf("CREATE vm: %s", err)
+	}
+
+	for _, name := range []string{"web2-fa163e000002-3", "web2-fa163e000003"} {
+		if len(m.find("vports", "name", name)) != 1 {
+			t.Errorf("CREATE vm: No vport named %s", name)
+		}
+	}
+}
+
+func TestMockLint(t *testing.T) {
+	m := mockconn(t)
+
+	// An interface on a deleted vport, and an L2 domain with a vport without interfaces
+	m.Lock()
+	m.objects["vminterfaces"]["a3a2b3c4-0000-4000-8000-000000000099"] = mockobject{"ID": "a3a2b3c4-0000-4000-8000-000000000099",
+		"name": "eth1", "MAC": "fa:16:3e:00:00:99", "VPortID": "00000000-0000-4000-8000-000000000000",
+		"parentID": "a2a2b3c4-0000-4000-8000-000000000001", "parentType": "vm"}
+	m.objects["l2domains"]["b1a2b3c4-0000-4000-8000-000000000001"] = mockobject{"ID": "b1a2b3c4-0000-4000-8000-000000000001",
+		"name": "ACME-L2", "parentID": mockorg, "parentType": "enterprise"}
+	m.objects["vports"]["b2a2b3c4-0000-4000-8000-000000000001"] = mockobject{"ID": "b2a2b3c4-0000-4000-8000-000000000001",
+		"name": "db1-port", "type": "VM", "parentID": "b1a2b3c4-0000-4000-8000-000000000001", "parentType": "l2domain"}
+	m.Unlock()
+
+	if _, err := Lint("enterprise", mockorg); err != nil {
+		t.Fatalf("LINT: %s", err)
+	}
+
+	found := make(map[string]string)
+	for _, r := range results {
+		id, _ := attribute(r, "ID")
+		severity, _ := attribute(r, "severity")
+		found[id] = severity
+	}
+
+	if found["a3a2b3c4-0000-4000-8000-000000000099"] != "ERROR" {
+		t.Errorf("LINT: Interface on a deleted vport not reported as an error")
+	}
+	if found["b2a2b3c4-0000-4000-8000-000000000001"] != "WARNING" {
+		t.Errorf("LINT: L2 domain vport without interfaces not reported")
+	}
+	if _, ok := found["a1a2b3c4-0000-4000-8000-000000000001"]; ok {
+		t.Errorf("LINT: Vport with an interface reported")
+	}
+
+	// The vports of the L2 domain cannot be fetched: Reported, and the rest checked
+	failing(t, "/l2domains/b1a2b3c4-0000-4000-8000-000000000001/vports", http.StatusForbidden)
+
+	if _, err := Lint("enterprise", mockorg); err != nil {
+		t.Fatalf("LINT, L2 domain vports failing: %s", err)
+	}
+
+	found = make(map[string]string)
+	for _, r := range results {
+		id, _ := attribute(r, "ID")
+		severity, _ := attribute(r, "severity")
+		found[id] = severity
+	}
+	if found["b1a2b3c4-0000-4000-8000-000000000001"] != "WARNING" {
+		t.Errorf("LINT, L2 domain vports failing: L2 domain not reported")
+	}
+	if found["a3a2b3c4-0000-4000-8000-000000000099"] != "ERROR" {
+		t.Errorf("LINT, L2 domain vports failing: Interface on a deleted vport not reported")
+	}
+}
+
+func TestMockReport(t *testing.T) {
+	mockconn(t)
+
+	if _, err := Report("summary", "--output", filepath.Join(t.TempDir(), "report.csv"), "--format", "csv"); err != nil {
+		t.Fatalf("REPORT summary: %s", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("REPORT summary: %d enterprise(s), want 1", len(results))
+	}
+	for attr, want := range map[string]string{"domains": "1", "zones": "2", "subnets": "2", "vports": "1", "vms": "1"} {
+		if got, _ := attribute(results[0], attr); got != want {
+			t.Errorf("REPORT summary: %s %s, want %s", attr, got, want)
+		}
+	}
+}
+
+// Current API key of the session
+func sessionkey() string {
+	reauthlock.Lock()
+	defer reauthlock.Unlock()
+
+	return apikey
+}
+
+func TestMockAllocSubnet(t *testing.T) {
+	mockconn(t)
+
+	// By zone, and by domain
+	for _, id := range []string{"e1a2b3c4-0000-4000-8000-000000000001", mockdomain} {
+		if _, err := Alloc("subnet", id, "/24", "--within", "10.1.0.0/16"); err != nil {
+			t.Fatalf("ALLOC subnet %s: %s", id, err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("ALLOC subnet %s: %d result(s), want 1", id, len(results))
+		}
+		if got, _ := attribute(results[0], "address"); got != "10.1.0.0" {
+			t.Errorf("ALLOC subnet %s: %s, want 10.1.0.0", id, got)
+		}
+	}
+
+	// Fetching the zone fails other than with 404: Not taken for a domain
+	failing(t, "/zones/e1a2b3c4-0000-4000-8000-000000000001", http.StatusForbidden)
+	if _, err := Alloc("subnet", "e1a2b3c4-0000-4000-8000-000000000001", "/24"); err == nil || notfound(err) {
+		t.Errorf("ALLOC subnet, zone failing: Error %v, want HTTP 403", err)
+	}
+}
+
+func TestMockAuditUpdate(t *testing.T) {
+	mockconn(t)
+
+	zone := vspk.NewZone()
+	zone.ID = "e1a2b3c4-0000-4000-8000-000000000001"
+	if err := zone.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	zone.Description = "Front end"
+	if err := zone.Save(); err != nil {
+		t.Fatalf("Updating a zone: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(auditfname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec auditrecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("Audit record of the update: %s", err)
+	}
+
+	var before, after map[string]interface{}
+	json.Unmarshal(rec.Before, &before)
+	json.Unmarshal(rec.After, &after)
+	if rec.Command != "UPDATE zone "+zone.ID || rec.Entity != "zone" || rec.ID != zone.ID || rec.Error != "" {
+		t.Errorf("Audit record of the update: %+v", rec)
+	}
+	if before["name"] != "Web" || before["description"] != nil || after["description"] != "Front end" {
+		t.Errorf("Audit record of the update: Before %v, after %v", before, after)
+	}
+
+	// The audit file cannot be written to: The update is refused
+	auditfname = filepath.Join(t.TempDir(), "missing", "audit.log")
+	zone.Description = "Back end"
+	if err := zone.Save(); err == nil {
+		t.Errorf("Updating a zone, audit file not writable: No error")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/abiosoft/ishell"
+)
+
+// Connection profiles, kept in ~/.nuage-vsd-shell.json:
+//
+// {
+//     "lab": {
+//         "url": "https://vsd.lab.example.com:8443",
+//         "user": "csproot",
+//         "organization": "csp",
+//         "apiVersion": "v5_0"
+//     },
+//     "production": {
+//         "url": "https://vsd.example.com:8443",
+//         "user": "l1support",
+//         "organization": "csp",
+//         "readOnly": true,
+//         "tlsCA": "/etc/pki/vsd-ca.pem",
+//         "tlsServerName": "vsd.example.com"
+//     }
+// }
+
+const profilefname = ".nuage-vsd-shell.json"
+
+type profile struct {
+	URL          string `json:"url"`
+	User         string `json:"user"`
+	Password     string `json:"password,omitempty"`
+	Organization string `json:"organization"`
+	APIVersion   string `json:"apiVersion,omitempty"`
+	ReadOnly     bool   `json:"readOnly,omitempty"`
+
+	// Client certificate and private key for "makecertconn" -- see "cert.go"
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	// TLS settings -- see "tls.go"
+	TLSCA         string `json:"tlsCA,omitempty"`
+	TLSInsecure   *bool  `json:"tlsInsecure,omitempty"`
+	TLSServerName string `json:"tlsServerName,omitempty"`
+	TLSPin        string `json:"tlsPin,omitempty"`
+}
+
+var (
+	// Name of the profile currently in use, if any
+	profilename string
+
+	// Read-only mode: Refuse any mutating operation. Once locked (by "--read-only" or by a read-only profile) it cannot
+	// be turned off for the rest of the session
+	readonly       bool
+	readonlylocked bool
+
+	// Settings a profile is applied to: The defaults, with the command line flags -- so that nothing carries over from
+	// the previous profile
+	profiledefaults struct {
+		apiversion, certfname, keyfname string
+		readonly, readonlylocked        bool
+	}
+)
+
+func profilepath() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, profilefname)
+}
+
+func readprofiles() (map[string]profile, error) {
+	profiles := make(map[string]profile)
+
+	data, err := ioutil.ReadFile(profilepath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("Invalid profiles file [%s]: %s", profilepath(), err)
+	}
+	return profiles, nil
+}
+
+// Load the connection details of a profile into the top level vars. Connect with "makeconn" afterwards
+func loadprofile(name string) error {
+	profiles, err := readprofiles()
+	if err != nil {
+		return err
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("No such profile: [%s]", name)
+	}
+
+	u, err := parsevsdurl(p.URL)
+	if err != nil {
+		return fmt.Errorf("Profile [%s]: Invalid VSD URL [%s]: %s", name, p.URL, err)
+	}
+
+	version := profiledefaults.apiversion
+	if p.APIVersion != "" {
+		if version, err = parseapiversion(p.APIVersion); err != nil {
+			return fmt.Errorf("Profile [%s]: %s", name, err)
+		}
+	}
+
+	resetconn()
+
+	profilename = ""
+	apiversion, certfname, keyfname = version, profiledefaults.certfname, profiledefaults.keyfname
+	readonly, readonlylocked = profiledefaults.readonly, profiledefaults.readonlylocked
+	tlsca, tlsroots, tlsinsecure, tlsservername, tlspin = "", nil, false, "", ""
+
+	vsdurl, user, passwd, org = u, p.User, p.Password, p.Organization
+
+	if p.Cert != "" {
+		certfname, keyfname = p.Cert, p.Key
+	}
+
+	if p.ReadOnly {
+		readonly, readonlylocked = true, true
+	}
+
+	if p.TLSCA != "" {
+		if err := loadca(p.TLSCA); err != nil {
+			return err
+		}
+		tlsinsecure = false
+	}
+	if p.TLSInsecure != nil {
+		tlsinsecure = *p.TLSInsecure
+	}
+	tlsservername, tlspin = p.TLSServerName, fingerprint(p.TLSPin)
+
+	profilename = name
+	return nil
+}
+
+// Record the settings profiles are applied to. Called once the command line flags are parsed
+func saveprofiledefaults() {
+	profiledefaults.apiversion, profiledefaults.certfname, profiledefaults.keyfname = apiversion, certfname, keyfname
+	profiledefaults.readonly, profiledefaults.readonlylocked = readonly, readonlylocked
+}
+
+// Select a profile, or list the available ones
+func selectprofile(args ...string) (string, error) {
+	switch len(args) {
+	case 0:
+		profiles, err := readprofiles()
+		if err != nil {
+			return "", err
+		}
+
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			current := " "
+			if name == profilename {
+				current = "*"
+			}
+			fmt.Printf(" %s %-16s %s\n", current, name, profiles[name].URL)
+		}
+		return "", nil
+	case 1:
+		if err := loadprofile(args[0]); err != nil {
+			return "", err
+		}
+		return "Using profile [" + args[0] + "]. Connect with `makeconn`", nil
+	}
+	return "Format: profile [ <name> ]", nil
+}
+
+// Set / display read-only mode
+func setreadonly(args ...string) (string, error) {
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			readonly = true
+		case "off":
+			if readonlylocked {
+				return "Read-only mode is enforced for this session and cannot be turned off", nil
+			}
+			readonly = false
+		default:
+			return "Format: readonly [ on | off ]", nil
+		}
+	}
+
+	if readonly {
+		return "Read-only mode is on", nil
+	}
+	return "Read-only mode is off", nil
+}
+
+// Wraps a shell command that changes VSD state, so that it is refused in read-only mode before any API call is made
+func mutating(name string, fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		if readonly {
+			return "Read-only mode: " + name + " refused", nil
+		}
+		return fn(args...)
+	}
+}
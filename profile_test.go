@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	profiles := `{
+		"production": {"url": "https://vsd.example.com:8443", "user": "l1support", "organization": "csp", "apiVersion": "v5_0",
+			"readOnly": true, "cert": "/etc/vsd/cert.pem", "key": "/etc/vsd/key.pem", "tlsInsecure": true,
+			"tlsServerName": "vsd.example.com", "tlsPin": "AB:CD"},
+		"lab": {"url": "vsd.lab.example.com", "user": "csproot", "organization": "csp"}
+	}`
+	if err := ioutil.WriteFile(filepath.Join(home, profilefname), []byte(profiles), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := profiledefaults
+	savedurl, saveduser, savedpasswd, savedorg, savedversion, savedcert, savedkey := vsdurl, user, passwd, org, apiversion, certfname, keyfname
+	t.Cleanup(func() {
+		profiledefaults, profilename = saved, ""
+		vsdurl, user, passwd, org, apiversion, certfname, keyfname = savedurl, saveduser, savedpasswd, savedorg, savedversion, savedcert, savedkey
+		readonly, readonlylocked = false, false
+		tlsca, tlsroots, tlsinsecure, tlsservername, tlspin = "", nil, false, "", ""
+	})
+
+	apiversion, certfname, keyfname, readonly, readonlylocked = "v4_0", "/root/cert.pem", "/root/key.pem", false, false
+	saveprofiledefaults()
+
+	if err := loadprofile("production"); err != nil {
+		t.Fatal(err)
+	}
+	if !readonly || !readonlylocked || !tlsinsecure || apiversion != "v5_0" || certfname != "/etc/vsd/cert.pem" || tlspin != "abcd" {
+		t.Fatalf("profile production: Not applied")
+	}
+
+	// Switching profiles: Nothing carries over
+	if err := loadprofile("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if readonly || readonlylocked {
+		t.Errorf("profile lab: Read-only mode carried over")
+	}
+	if tlsinsecure || tlsservername != "" || tlspin != "" || tlsca != "" || tlsroots != nil {
+		t.Errorf("profile lab: TLS settings carried over")
+	}
+	if apiversion != "v4_0" || certfname != "/root/cert.pem" || keyfname != "/root/key.pem" {
+		t.Errorf("profile lab: API version %s, certificate %s, key %s carried over", apiversion, certfname, keyfname)
+	}
+	if vsdurl != "https://vsd.lab.example.com:8443" || user != "csproot" || profilename != "lab" {
+		t.Errorf("profile lab: Not applied")
+	}
+
+	// Unknown / invalid profiles leave the current one in place
+	if err := loadprofile("staging"); err == nil || profilename != "lab" {
+		t.Errorf("profile staging: Error %v, profile [%s]", err, profilename)
+	}
+}
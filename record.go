@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Record / replay of Nuage API sessions.
+//
+// "record start <file>" writes every API call made -- request and response -- to a cassette file, one JSON object per
+// line. Secrets are scrubbed: The Authorization header is not recorded, passwords and API keys are redacted.
+//
+// "--replay <file>" runs the shell against a cassette instead of a VSD, logging in with the recorded login: API calls are
+// answered with the recorded responses, matched by method, URL path and query, filter and page. Calls recorded several times are answered in the
+// recorded order, the last answer being repeated.
+
+// Largest response body recorded
+const maxrecordbody = 64 << 20
+
+// A recorded API call
+type interaction struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeaders http.Header `json:"requestHeaders,omitempty"`
+	RequestBody    string      `json:"requestBody,omitempty"`
+	Status         int         `json:"status"`
+	Headers        http.Header `json:"headers,omitempty"`
+	Body           string      `json:"body,omitempty"`
+}
+
+// Cassette being replayed: Recorded API calls by key, in order
+type cassette struct {
+	sync.Mutex
+
+	fname string
+	calls map[string][]*interaction
+	first *interaction
+}
+
+var (
+	recordlock sync.Mutex
+	recordfile *os.File
+
+	replaying *cassette
+)
+
+// Headers that are part of the key a recorded API call is matched by
+var keyheaders = []string{"X-Nuage-Filter", "X-Nuage-Page", "X-Nuage-PageSize", "X-Nuage-OrderBy"}
+
+func cassettekey(method, rawurl string, h http.Header) string {
+	uri := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		uri = u.RequestURI()
+	}
+
+	key := method + " " + uri
+	for _, name := range keyheaders {
+		if v := h.Get(name); v != "" {
+			key += " " + name + ": " + v
+		}
+	}
+	return key
+}
+
+// Copy of a set of headers, without the credentials
+func scrubheaders(h http.Header) http.Header {
+	scrubbed := http.Header{}
+	for name, values := range h {
+		if strings.EqualFold(name, "Authorization") || strings.EqualFold(name, "Set-Cookie") || strings.EqualFold(name, "Cookie") {
+			continue
+		}
+		scrubbed[name] = values
+	}
+	return scrubbed
+}
+
+// Record every API call while a cassette is open
+func recorder(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		recordlock.Lock()
+		recording := recordfile != nil
+		recordlock.Unlock()
+
+		if !recording {
+			return next.RoundTrip(req)
+		}
+
+		var reqbody []byte
+		if req.GetBody != nil {
+			if body, err := req.GetBody(); err == nil {
+				reqbody = readbody(&body, maxrecordbody)
+			}
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+
+		call := &interaction{
+			Method:         req.Method,
+			URL:            req.URL.String(),
+			RequestHeaders: scrubheaders(req.Header),
+			RequestBody:    redactbody(reqbody),
+			Status:         resp.StatusCode,
+			Headers:        scrubheaders(resp.Header),
+			Body:           redactbody(readbody(&resp.Body, maxrecordbody)),
+		}
+
+		recordlock.Lock()
+		defer recordlock.Unlock()
+
+		if recordfile != nil {
+			if werr := json.NewEncoder(recordfile).Encode(call); werr != nil {
+				log.Warnf("Recording to %s failed: %s", recordfile.Name(), werr)
+			}
+		}
+		return resp, err
+	})
+}
+
+// Answer API calls from the cassette being replayed
+func (c *cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	key := cassettekey(req.Method, req.URL.String(), req.Header)
+
+	calls := c.calls[key]
+	if len(calls) == 0 {
+		log.WithField("call", key).Warn("API call not in the recording")
+
+		data, _ := json.Marshal(map[string]string{
+			"title":       "Not recorded",
+			"description": key + " is not in the recording " + c.fname,
+		})
+		return newresponse(req, http.StatusNotFound, http.Header{"Content-Type": {"application/json"}}, data), nil
+	}
+
+	call := calls[0]
+	if len(calls) > 1 {
+		c.calls[key] = calls[1:]
+	}
+
+	return newresponse(req, call.Status, call.Headers, []byte(call.Body)), nil
+}
+
+// Load a cassette for replay
+func loadcassette(fname string) (*cassette, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &cassette{
+		fname: fname,
+		calls: make(map[string][]*interaction),
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxrecordbody+1<<20)
+
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		call := new(interaction)
+		if err := json.Unmarshal(scanner.Bytes(), call); err != nil {
+			return nil, fmt.Errorf("%s, line %d: %s", fname, n, err)
+		}
+
+		key := cassettekey(call.Method, call.URL, call.RequestHeaders)
+		c.calls[key] = append(c.calls[key], call)
+		if c.first == nil {
+			c.first = call
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+
+	if c.first == nil {
+		return nil, fmt.Errorf("%s: Empty recording", fname)
+	}
+	return c, nil
+}
+
+// Replay a cassette: Connection details are taken from the recording
+func startreplay(fname string) error {
+	c, err := loadcassette(fname)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(c.first.URL)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fname, err)
+	}
+
+	i := strings.Index(u.Path, apiprefix)
+	if i < 0 {
+		return fmt.Errorf("%s: Not a Nuage API recording: %s", fname, c.first.URL)
+	}
+	version := strings.SplitN(u.Path[i+len(apiprefix):], "/", 2)[0]
+
+	vsdurl = u.Scheme + "://" + u.Host + u.Path[:i]
+	apiversion = version
+
+	if user == "" {
+		user = "replay"
+	}
+	if passwd == "" {
+		passwd = "replay"
+	}
+	if o := c.first.RequestHeaders.Get("X-Nuage-Organization"); o != "" {
+		org = o
+	}
+
+	// The shell connects by logging in
+	login := vsdurl + apiprefix + apiversion + "/me"
+	if len(c.calls[cassettekey("GET", login, nil)]) == 0 {
+		return fmt.Errorf("%s: No login (GET %s) in the recording. Recordings must be started before \"makeconn\" / \"makecertconn\", or on a live connection", fname, login)
+	}
+
+	replaying = c
+	return nil
+}
+
+// Start recording to a new cassette. On a live connection the login is recorded first -- by logging in again -- so
+// that the cassette can be replayed.
+func startrecording(fname string) (string, error) {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	recordlock.Lock()
+	if recordfile != nil {
+		recordfile.Close()
+	}
+	recordfile = f
+	recordlock.Unlock()
+
+	if root == nil || replaying != nil {
+		return "Recording to " + fname, nil
+	}
+	if err := root.Fetch(); err != nil {
+		return "Recording to " + fname + ". Warning: Recording the login failed, the recording cannot be replayed", err
+	}
+	return "Recording to " + fname, nil
+}
+
+// Start / stop recording
+func record(args ...string) (string, error) {
+	if len(args) == 2 && args[0] == "start" {
+		return startrecording(args[1])
+	}
+
+	recordlock.Lock()
+	defer recordlock.Unlock()
+
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "stop":
+		if recordfile == nil {
+			return "Not recording", nil
+		}
+		fname := recordfile.Name()
+		err := recordfile.Close()
+		recordfile = nil
+		return "Recording saved to " + fname, err
+	default:
+		return "Format: record [ start <file> | stop ]", nil
+	}
+
+	if recordfile == nil {
+		return "Not recording", nil
+	}
+	return "Recording to " + recordfile.Name(), nil
+}
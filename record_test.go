@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCassetteKey(t *testing.T) {
+	tests := []struct {
+		method, url string
+		h           http.Header
+		want        string
+	}{
+		{"GET", "https://vsd:8443/nuage/api/v5_0/enterprises", nil, "GET /nuage/api/v5_0/enterprises"},
+		{"DELETE", "https://vsd:8443/nuage/api/v5_0/zones/z1?responseChoice=1", nil, "DELETE /nuage/api/v5_0/zones/z1?responseChoice=1"},
+		{"GET", "https://vsd:8443/nuage/api/v5_0/enterprises", http.Header{"X-Nuage-Filter": {`name == "ACME"`}},
+			`GET /nuage/api/v5_0/enterprises X-Nuage-Filter: name == "ACME"`},
+		{"GET", "https://vsd:8443/nuage/api/v5_0/vports", http.Header{"X-Nuage-Page": {"2"}, "X-Nuage-Organization": {"csp"}},
+			"GET /nuage/api/v5_0/vports X-Nuage-Page: 2"},
+	}
+
+	for _, tt := range tests {
+		if got := cassettekey(tt.method, tt.url, tt.h); got != tt.want {
+			t.Errorf("cassettekey(%s, %s, %v) = %q, want %q", tt.method, tt.url, tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestScrubHeaders(t *testing.T) {
+	h := http.Header{
+		"Authorization":        {"XREST Y3Nwcm9vdDpjc3Byb290"},
+		"Cookie":               {"JSESSIONID=1"},
+		"Set-Cookie":           {"JSESSIONID=2"},
+		"X-Nuage-Organization": {"csp"},
+	}
+
+	scrubbed := scrubheaders(h)
+	if len(scrubbed) != 1 || scrubbed.Get("X-Nuage-Organization") != "csp" {
+		t.Errorf("scrubheaders: %v, want only X-Nuage-Organization", scrubbed)
+	}
+	if h.Get("Authorization") == "" {
+		t.Errorf("scrubheaders: Headers scrubbed in place")
+	}
+}
+
+func TestStartReplayNoLogin(t *testing.T) {
+	savedurl, savedversion := vsdurl, apiversion
+	defer func() { vsdurl, apiversion, replaying = savedurl, savedversion, nil }()
+
+	fname := filepath.Join(t.TempDir(), "nologin.cassette")
+	call := `{"method":"GET","url":"https://vsd:8443/nuage/api/v5_0/enterprises","status":200,"body":"[]"}` + "\n"
+	if err := os.WriteFile(fname, []byte(call), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := startreplay(fname); err == nil || replaying != nil {
+		t.Errorf("startreplay of a recording without a login: No error")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Relay of the Nuage API calls of the bambou session. bambou does not give access to the HTTP client of a session, so
+// the session is pointed at the relay instead: An HTTP server on the loopback interface that passes the API calls on to
+// the VSD through the transport chain (see "transport.go"). The relay only serves URLs under a random path, so that
+// other local users cannot make API calls with the session credentials.
+
+type relay struct {
+	server *http.Server
+
+	// URL bambou is given, "http://127.0.0.1:<port>/<random>", and its path
+	url, prefix string
+
+	// VSD URL the API calls are passed on to
+	upstream string
+
+	next http.RoundTripper
+}
+
+var apirelay *relay
+
+// Headers that only apply to a single HTTP connection, or that the HTTP transport to the VSD sets itself. The VSD
+// responses are decompressed by that transport, so that the transport chain sees them as they are
+var hopheaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Accept-Encoding", "Content-Encoding", "Content-Length"}
+
+func startrelay(upstream string, next http.RoundTripper) (*relay, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	r := &relay{
+		prefix:   "/" + hex.EncodeToString(secret),
+		upstream: upstream,
+		next:     next,
+	}
+	r.url = "http://" + l.Addr().String() + r.prefix
+	r.server = &http.Server{Handler: r}
+
+	go r.server.Serve(l)
+	return r, nil
+}
+
+func (r *relay) close() {
+	r.server.Close()
+}
+
+func (r *relay) ServeHTTP(w http.ResponseWriter, in *http.Request) {
+	if !strings.HasPrefix(in.URL.Path, r.prefix+"/") {
+		http.NotFound(w, in)
+		return
+	}
+
+	// Buffered, so that the transport chain can read it again -- e.g. to retry the API call
+	data, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		relayerror(w, http.StatusBadRequest, err)
+		return
+	}
+	var body io.Reader
+	if len(data) > 0 {
+		body = bytes.NewReader(data)
+	}
+
+	u := r.upstream + strings.TrimPrefix(in.URL.EscapedPath(), r.prefix)
+	if in.URL.RawQuery != "" {
+		u += "?" + in.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(in.Method, u, body)
+	if err != nil {
+		relayerror(w, http.StatusBadRequest, err)
+		return
+	}
+	req.Header = in.Header.Clone()
+	for _, name := range hopheaders {
+		req.Header.Del(name)
+	}
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		relayerror(w, http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	for _, name := range hopheaders {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Reply to bambou when an API call could not be made, as VSD reports errors
+func relayerror(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"title":       "HTTP transaction error",
+		"description": err.Error(),
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRelay(t *testing.T) {
+	var seen *http.Request
+	var seenbody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		seen, seenbody = r, string(data)
+		w.Header().Set("X-Nuage-Count", "1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`[{"ID": "x"}]`))
+	}))
+	defer upstream.Close()
+
+	r, err := startrelay(upstream.URL+"/proxy", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.close()
+
+	req, _ := http.NewRequest("POST", r.url+"/nuage/api/v5_0/zones/z1/subnets?responseChoice=1", strings.NewReader(`{"name": "a"}`))
+	req.Header.Set("X-Nuage-Organization", "csp")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated || string(body) != `[{"ID": "x"}]` || resp.Header.Get("X-Nuage-Count") != "1" {
+		t.Errorf("Relayed response: %d %s, X-Nuage-Count [%s]", resp.StatusCode, body, resp.Header.Get("X-Nuage-Count"))
+	}
+	if seen == nil || seen.Method != "POST" || seen.URL.RequestURI() != "/proxy/nuage/api/v5_0/zones/z1/subnets?responseChoice=1" {
+		t.Fatalf("Relayed request: %v", seen)
+	}
+	if seenbody != `{"name": "a"}` || seen.Header.Get("X-Nuage-Organization") != "csp" {
+		t.Errorf("Relayed request: Body [%s], organization [%s]", seenbody, seen.Header.Get("X-Nuage-Organization"))
+	}
+
+	// Only the URLs under the secret path are relayed
+	seen = nil
+	u := strings.TrimSuffix(r.url, r.prefix)
+	for _, path := range []string{"/nuage/api/v5_0/me", r.prefix + "x/nuage/api/v5_0/me", "/"} {
+		resp, err := http.Get(u + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || seen != nil {
+			t.Errorf("GET %s: %d, want 404 without relaying", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// REPORT: Inventory statistics, as text, CSV, JSON or Markdown -- on screen or to a file.
+
+// Counts for an enterprise
+type orgsummary struct {
+	Enterprise string `json:"enterprise"`
+	ID         string `json:"ID"`
+
+	Domains    int `json:"domains"`
+	L2Domains  int `json:"l2domains"`
+	Zones      int `json:"zones"`
+	Subnets    int `json:"subnets"`
+	VPorts     int `json:"vports"`
+	VMs        int `json:"vms"`
+	Containers int `json:"containers"`
+	ACLEntries int `json:"ACLEntries"`
+
+	// Quotas are per enterprise: None in totals
+	FloatingIPsUsed  int  `json:"floatingIPsUsed"`
+	FloatingIPsQuota *int `json:"floatingIPsQuota,omitempty"`
+}
+
+// Enterprise that could not be counted
+type orgfailure struct {
+	Enterprise string `json:"enterprise"`
+	ID         string `json:"ID"`
+	Error      string `json:"error"`
+}
+
+var summarycolumns = []string{"Enterprise", "ID", "Domains", "L2 domains", "Zones", "Subnets", "VPorts", "VMs", "Containers",
+	"ACL entries", "Floating IPs used", "Floating IPs quota"}
+
+func (s *orgsummary) row() []string {
+	quota := ""
+	if s.FloatingIPsQuota != nil {
+		quota = strconv.Itoa(*s.FloatingIPsQuota)
+	}
+	return []string{s.Enterprise, s.ID, strconv.Itoa(s.Domains), strconv.Itoa(s.L2Domains), strconv.Itoa(s.Zones),
+		strconv.Itoa(s.Subnets), strconv.Itoa(s.VPorts), strconv.Itoa(s.VMs), strconv.Itoa(s.Containers),
+		strconv.Itoa(s.ACLEntries), strconv.Itoa(s.FloatingIPsUsed), quota}
+}
+
+// Row of an enterprise that could not be counted: The error in place of the counts
+func (f *orgfailure) row() []string {
+	row := make([]string, len(summarycolumns))
+	row[0], row[1], row[2] = f.Enterprise, f.ID, "Not counted: "+f.Error
+	return row
+}
+
+func (s *orgsummary) add(o *orgsummary) {
+	s.Domains += o.Domains
+	s.L2Domains += o.L2Domains
+	s.Zones += o.Zones
+	s.Subnets += o.Subnets
+	s.VPorts += o.VPorts
+	s.VMs += o.VMs
+	s.Containers += o.Containers
+	s.ACLEntries += o.ACLEntries
+	s.FloatingIPsUsed += o.FloatingIPsUsed
+}
+
+// Count the objects of an enterprise
+func summarize(ctx context.Context, org *vspk.Enterprise, containers bool) (*orgsummary, error) {
+	quota := org.FloatingIPsQuota
+	s := &orgsummary{
+		Enterprise:       org.Name,
+		ID:               org.ID,
+		FloatingIPsUsed:  org.FloatingIPsUsed,
+		FloatingIPsQuota: &quota,
+	}
+
+	dl, err := org.Domains(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, err
+	}
+	l2l, err := org.L2Domains(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, err
+	}
+	vml, err := org.VMs(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, err
+	}
+	s.Domains, s.L2Domains, s.VMs = len(dl), len(l2l), len(vml)
+
+	if containers {
+		cl, err := org.Containers(&bambou.FetchingInfo{})
+		if err != nil {
+			return nil, err
+		}
+		s.Containers = len(cl)
+	}
+
+	var lock sync.Mutex
+
+	if ferr := fanout(ctx, len(dl), func(ctx context.Context, i int) error {
+		zl, err := dl[i].Zones(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		sl, err := dl[i].Subnets(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		vpl, err := dl[i].VPorts(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		acls, aerr := fetchacls(dl[i])
+		if aerr != nil {
+			return aerr
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		s.Zones += len(zl)
+		s.Subnets += len(sl)
+		s.VPorts += len(vpl)
+		s.ACLEntries += len(acls)
+		return nil
+	}); ferr != nil {
+		return nil, ferr
+	}
+
+	if ferr := fanout(ctx, len(l2l), func(ctx context.Context, i int) error {
+		vpl, err := l2l[i].VPorts(&bambou.FetchingInfo{})
+		if err != nil {
+			return err
+		}
+		acls, aerr := fetchacls(l2l[i])
+		if aerr != nil {
+			return aerr
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		s.VPorts += len(vpl)
+		s.ACLEntries += len(acls)
+		return nil
+	}); ferr != nil {
+		return nil, ferr
+	}
+
+	return s, nil
+}
+
+func writesummary(w io.Writer, format string, orgs []*orgsummary, total *orgsummary, failed []*orgfailure) error {
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write(summarycolumns)
+		for _, s := range orgs {
+			cw.Write(s.row())
+		}
+		cw.Write(total.row())
+		for _, f := range failed {
+			cw.Write(f.row())
+		}
+		cw.Flush()
+		return cw.Error()
+
+	case "json":
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"vsdURL":      vsdurl,
+			"generated":   time.Now().UTC(),
+			"enterprises": orgs,
+			"total":       total,
+			"failed":      failed,
+		}, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+
+	case "markdown":
+		fmt.Fprintf(w, "# VSD inventory summary\n\nVSD %s, %s\n\n", vsdurl, time.Now().UTC().Format("2006-01-02 15:04 MST"))
+		fmt.Fprintf(w, "| %s |\n", strings.Join(summarycolumns, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(summarycolumns)))
+		for _, s := range append(orgs, total) {
+			row := s.row()
+			for i := range row {
+				row[i] = strings.Replace(row[i], "|", `\|`, -1)
+			}
+			fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+		}
+		if len(failed) > 0 {
+			fmt.Fprintf(w, "\nNot counted:\n\n")
+			for _, f := range failed {
+				fmt.Fprintf(w, "- %s [%s]: %s\n", f.Enterprise, f.ID, f.Error)
+			}
+		}
+		return nil
+	}
+
+	// Text
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(summarycolumns, "\t"))
+	for _, s := range append(orgs, total) {
+		fmt.Fprintln(tw, strings.Join(s.row(), "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(w, "\nNot counted:\n")
+		for _, f := range failed {
+			fmt.Fprintf(w, "    %s [%s]: %s\n", f.Enterprise, f.ID, f.Error)
+		}
+	}
+	return nil
+}
+
+// REPORT summary [ --format text | csv | json | markdown ] [ --output <file> ]
+func Report(args ...string) (string, error) {
+	const format = "Format: REPORT summary [ --format text | csv | json | markdown ] [ --output <file> ]"
+
+	if root == nil {
+		return "Not Connected to a VSD server", nil
+	}
+
+	if len(args) < 1 || args[0] != "summary" || len(args)%2 != 1 {
+		return format, nil
+	}
+
+	reportformat, output := "text", ""
+	for i := 1; i < len(args); i += 2 {
+		switch args[i] {
+		case "--format":
+			reportformat = args[i+1]
+			if reportformat != "text" && reportformat != "csv" && reportformat != "json" && reportformat != "markdown" {
+				return format, nil
+			}
+		case "--output":
+			output = args[i+1]
+		default:
+			return format, nil
+		}
+	}
+
+	orgs, err := root.Enterprises(&bambou.FetchingInfo{})
+	if err != nil {
+		return "", err
+	}
+
+	containers := unsupported("REPORT", "containers") == ""
+
+	// Enterprises that cannot be counted -- e.g. for lack of permissions -- are reported, and the others counted regardless
+	counted := make([]*orgsummary, len(orgs))
+	errs, ferr := fanouteach(cmdctx, len(orgs), func(ctx context.Context, i int) error {
+		s, err := summarize(ctx, orgs[i], containers)
+		counted[i] = s
+		return err
+	})
+	if ferr != nil {
+		return "", ferr
+	}
+
+	var (
+		summaries []*orgsummary
+		failed    []*orgfailure
+	)
+	for i, s := range counted {
+		if errs[i] != nil {
+			failed = append(failed, &orgfailure{orgs[i].Name, orgs[i].ID, errs[i].Error()})
+			continue
+		}
+		summaries = append(summaries, s)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Enterprise < summaries[j].Enterprise })
+
+	total := &orgsummary{Enterprise: "TOTAL"}
+	for _, s := range summaries {
+		total.add(s)
+	}
+	keep(summaries)
+
+	notcounted := ""
+	if len(failed) > 0 {
+		var names []string
+		for _, f := range failed {
+			names = append(names, fmt.Sprintf("%s [%s]: %s", f.Enterprise, f.ID, f.Error))
+		}
+		notcounted = fmt.Sprintf(". %d enterprise(s) not counted:\n    %s", len(failed), strings.Join(names, "\n    "))
+	}
+
+	if output == "" {
+		if err := writesummary(os.Stdout, reportformat, summaries, total, failed); err != nil {
+			return "", err
+		}
+		return "REPORT summary -- done" + notcounted, nil
+	}
+
+	f, ferr := os.Create(output)
+	if ferr != nil {
+		return "", ferr
+	}
+	if err := writesummary(f, reportformat, summaries, total, failed); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("REPORT summary -- done: %d enterprise(s), written to %s", len(summaries), output) + notcounted, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSummaryTotal(t *testing.T) {
+	q1, q2 := 10, 20
+	orgs := []*orgsummary{
+		{Enterprise: "A", ID: "a", Domains: 2, VPorts: 5, FloatingIPsUsed: 3, FloatingIPsQuota: &q1},
+		{Enterprise: "B", ID: "b", Domains: 1, VPorts: 1, FloatingIPsUsed: 4, FloatingIPsQuota: &q2},
+	}
+
+	total := &orgsummary{Enterprise: "TOTAL"}
+	for _, s := range orgs {
+		total.add(s)
+	}
+	if total.Domains != 3 || total.VPorts != 6 || total.FloatingIPsUsed != 7 || total.FloatingIPsQuota != nil {
+		t.Errorf("TOTAL: %+v", total)
+	}
+
+	// No quota in the total row
+	row := total.row()
+	if quota := row[len(row)-1]; quota != "" {
+		t.Errorf("TOTAL row: Floating IPs quota [%s], want none", quota)
+	}
+	if row := orgs[0].row(); row[len(row)-1] != "10" {
+		t.Errorf("Row of A: Floating IPs quota [%s], want 10", row[len(row)-1])
+	}
+
+	failed := []*orgfailure{{"C", "c", "403 Forbidden"}}
+
+	var buf bytes.Buffer
+	if err := writesummary(&buf, "json", orgs, total, failed); err != nil {
+		t.Fatal(err)
+	}
+	var report struct {
+		Total  map[string]interface{} `json:"total"`
+		Failed []*orgfailure          `json:"failed"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("JSON report: %s", err)
+	}
+	if _, ok := report.Total["floatingIPsQuota"]; ok {
+		t.Errorf("JSON report: Floating IPs quota in the total")
+	}
+	if len(report.Failed) != 1 || report.Failed[0].Enterprise != "C" {
+		t.Errorf("JSON report: failed %v, want C", report.Failed)
+	}
+
+	buf.Reset()
+	if err := writesummary(&buf, "markdown", orgs, total, failed); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "- C [c]: 403 Forbidden") {
+		t.Errorf("Markdown report: Enterprise C not listed as not counted")
+	}
+
+	buf.Reset()
+	if err := writesummary(&buf, "csv", orgs, total, failed); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV report: %s", err)
+	}
+	if last := records[len(records)-1]; len(records) != 5 || last[0] != "C" || last[2] != "Not counted: 403 Forbidden" {
+		t.Errorf("CSV report: Enterprise C not listed as not counted: %q", records)
+	}
+
+	buf.Reset()
+	if err := writesummary(&buf, "text", orgs, total, failed); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Not counted:\n    C [c]: 403 Forbidden") {
+		t.Errorf("Text report: Enterprise C not listed as not counted")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/abiosoft/ishell"
+)
+
+// Shell variables, aliases and "foreach" loops.
+//
+//   set ORG=30d5ac86-edfa-49e0-afcc-786b63b41e9a
+//   alias lsd="GET enterprises $ORG domains"
+//   foreach id in $(GET domains --ids) { GET domains $id vports ; GET domains $id vminterfaces }
+
+// Max nesting of aliases / "foreach" bodies. Guards against e.g. an alias that invokes itself
+const maxdepth = 16
+
+var (
+	// All registered shell commands, so they can be invoked from aliases and "foreach" bodies
+	commands = make(map[string]ishell.CmdFunc)
+
+	vars    = make(map[string]string)
+	aliases = make(map[string]string)
+
+	// Shell variable names, and references to them: $NAME or ${NAME}
+	varname = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	varref  = regexp.MustCompile(`\$(?:\{([A-Za-z][A-Za-z0-9_]*)\}|([A-Za-z][A-Za-z0-9_]*))`)
+
+	// <var> in <list> { <command> [ ; <command> ... ] }
+	foreachsyntax = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)\s+in\s+(.*?)\s*\{(.*)\}\s*$`)
+
+	depth int
+)
+
+// Registers a shell command. Variables and result buffer references in its arguments are expanded before it is invoked.
+// See "errors.go", "session.go" and "version.go" for the other wrappers.
+func register(name string, fn ishell.CmdFunc) {
+	commands[name] = withlogging(name, witherrors(name, withsession(withcontext(withfresh(withexpansion(withversion(name, fn)))))))
+	shell.Register(name, commands[name])
+}
+
+// Registers a shell command that expands its arguments itself, e.g. "alias" or "foreach"
+func registerverbatim(name string, fn ishell.CmdFunc) {
+	commands[name] = withlogging(name, witherrors(name, withsession(withcontext(fn))))
+	shell.Register(name, commands[name])
+}
+
+// Expand shell variables in a command argument
+func expandvars(arg string) (string, error) {
+	var err error
+
+	expanded := varref.ReplaceAllStringFunc(arg, func(ref string) string {
+		m := varref.FindStringSubmatch(ref)
+		name := m[1] + m[2]
+
+		val, ok := vars[name]
+		if !ok {
+			err = fmt.Errorf("Cannot expand [%s]: Variable [%s] is not set", ref, name)
+			return ref
+		}
+		return val
+	})
+
+	return expanded, err
+}
+
+// Expand shell variables, then result buffer references, in command arguments
+func expand(args []string) ([]string, error) {
+	expanded := make([]string, len(args))
+
+	for i, arg := range args {
+		val, err := expandvars(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		if expanded[i], err = expandresults(val); err != nil {
+			return nil, err
+		}
+	}
+
+	return expanded, nil
+}
+
+// Wraps a shell command so that its arguments are expanded before it is invoked
+func withexpansion(fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		args, err := expand(args)
+		if err != nil {
+			return "", err
+		}
+		return fn(args...)
+	}
+}
+
+// Split a command line into arguments. Single or double quotes group words into a single argument.
+func tokenize(line string) []string {
+	var (
+		tokens  []string
+		token   []rune
+		quote   rune
+		intoken bool
+	)
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				token = append(token, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			intoken = true
+		case unicode.IsSpace(r):
+			if intoken {
+				tokens = append(tokens, string(token))
+				token = token[:0]
+				intoken = false
+			}
+		default:
+			token = append(token, r)
+			intoken = true
+		}
+	}
+
+	if intoken {
+		tokens = append(tokens, string(token))
+	}
+	return tokens
+}
+
+// Run a command line through the registered shell commands
+func run(line string) error {
+	args := tokenize(line)
+	if len(args) == 0 {
+		return nil
+	}
+
+	fn, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", args[0])
+	}
+
+	if depth >= maxdepth {
+		return fmt.Errorf("Too many nested aliases / foreach loops running [%s]", line)
+	}
+	depth++
+	defer func() { depth-- }()
+
+	out, err := fn(args[1:]...)
+	if out != "" {
+		fmt.Println(out)
+	}
+	return err
+}
+
+// Run "fn" with its standard output discarded
+func silently(fn func()) {
+	stdout := os.Stdout
+
+	if devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stdout = devnull
+		defer devnull.Close()
+	}
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+}
+
+// Set / display shell variables
+func setvar(args ...string) (string, error) {
+	if len(args) == 0 {
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Printf("  %s=%s\n", name, vars[name])
+		}
+		return "", nil
+	}
+
+	// Accept both "set NAME=value" and "set NAME value"
+	def := strings.Join(args, " ")
+	name, val := def, ""
+	if i := strings.IndexAny(def, "= "); i >= 0 {
+		name, val = def[:i], strings.TrimSpace(def[i+1:])
+	}
+
+	if !varname.MatchString(name) {
+		return "Format: set <NAME>=<value>  (NAME: letters, digits and '_', starting with a letter)", nil
+	}
+
+	vars[name] = strings.Trim(val, `"'`)
+	return "", nil
+}
+
+func unsetvar(args ...string) (string, error) {
+	if len(args) != 1 {
+		return "Format: unset <NAME>", nil
+	}
+	delete(vars, args[0])
+	return "", nil
+}
+
+// Define / display aliases. The definition is expanded when the alias is invoked, not when it is defined
+func alias(args ...string) (string, error) {
+	if len(args) == 0 {
+		names := make([]string, 0, len(aliases))
+		for name := range aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fmt.Printf("  alias %s=\"%s\"\n", name, aliases[name])
+		}
+		return "", nil
+	}
+
+	def := strings.Join(args, " ")
+	i := strings.Index(def, "=")
+	if i <= 0 {
+		return "Format: alias <name>=\"<command line>\"", nil
+	}
+
+	name, line := strings.TrimSpace(def[:i]), strings.Trim(strings.TrimSpace(def[i+1:]), `"'`)
+
+	if _, ok := commands[name]; ok {
+		if _, isalias := aliases[name]; !isalias {
+			return "Cannot redefine shell command [" + name + "] as an alias", nil
+		}
+	}
+
+	aliases[name] = line
+
+	// Aliases are dispatched like any other command. Extra arguments are appended to the alias definition
+	commands[name] = withlogging(name, witherrors(name, withsession(withcontext(func(args ...string) (string, error) {
+		return "", run(aliases[name] + " " + strings.Join(args, " "))
+	}))))
+	shell.Register(name, commands[name])
+
+	return "", nil
+}
+
+func unalias(args ...string) (string, error) {
+	if len(args) != 1 {
+		return "Format: unalias <name>", nil
+	}
+	if _, ok := aliases[args[0]]; !ok {
+		return "No such alias: " + args[0], nil
+	}
+
+	delete(aliases, args[0])
+	delete(commands, args[0])
+	shell.Unregister(args[0])
+	return "", nil
+}
+
+// foreach <var> in <list> { <command> [ ; <command> ... ] }
+//
+// <list> is either a list of words (variables and result buffer references are expanded) or "$(<command>)", in which case
+// the list consists of the IDs of the objects returned by <command>.
+func foreach(args ...string) (string, error) {
+	const format = "Format: foreach <var> in <word> ... | $(<command>) { <command> [ ; <command> ... ] }"
+
+	m := foreachsyntax.FindStringSubmatch(strings.Join(args, " "))
+	if m == nil {
+		return format, nil
+	}
+
+	name, list, body := m[1], m[2], m[3]
+
+	var items []string
+
+	if strings.HasPrefix(list, "$(") && strings.HasSuffix(list, ")") {
+		var err error
+
+		results = nil
+		silently(func() {
+			err = run(list[2 : len(list)-1])
+		})
+		if err != nil {
+			return "", err
+		}
+
+		for _, obj := range results {
+			id, _ := attribute(obj, "ID")
+			items = append(items, id)
+		}
+	} else {
+		var err error
+		if items, err = expand(tokenize(list)); err != nil {
+			return "", err
+		}
+	}
+
+	// The loop variable shadows any shell variable with the same name
+	saved, wasset := vars[name]
+	defer func() {
+		if wasset {
+			vars[name] = saved
+		} else {
+			delete(vars, name)
+		}
+	}()
+
+	for _, item := range items {
+		vars[name] = item
+
+		for _, line := range strings.Split(body, ";") {
+			if cmdctx.Err() != nil {
+				return "", errinterrupted
+			}
+			if err := run(line); err != nil {
+				fmt.Printf("Error: %s\n", err)
+			}
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"GET enterprises", []string{"GET", "enterprises"}},
+		{"  GET   enterprises  ", []string{"GET", "enterprises"}},
+		{`alias lsd="GET enterprises $ORG domains"`, []string{"alias", "lsd=GET enterprises $ORG domains"}},
+		{`set NAME='Web tier'`, []string{"set", "NAME=Web tier"}},
+		{`echo "it's"`, []string{"echo", "it's"}},
+		{`echo 'say "hi"'`, []string{"echo", `say "hi"`}},
+		{`CREATE Policy ""`, []string{"CREATE", "Policy", ""}},
+		{"a\tb\nc", []string{"a", "b", "c"}},
+		{`unterminated "quote here`, []string{"unterminated", "quote here"}},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	savedvars, savedresults := vars, results
+	defer func() { vars, results = savedvars, savedresults }()
+
+	vars = map[string]string{"ORG": "30d5ac86", "D": "dom-1"}
+	results = []interface{}{
+		map[string]interface{}{"ID": "id-0", "name": "first", "parentID": "30d5ac86"},
+		map[string]interface{}{"ID": "id-1", "name": "second", "address": nil},
+	}
+
+	tests := []struct {
+		args    []string
+		want    []string
+		wanterr bool
+	}{
+		{[]string{"GET", "enterprises"}, []string{"GET", "enterprises"}, false},
+		{[]string{"$ORG"}, []string{"30d5ac86"}, false},
+		{[]string{"${ORG}-x", "$D/$ORG"}, []string{"30d5ac86-x", "dom-1/30d5ac86"}, false},
+		{[]string{"$_"}, []string{"id-1"}, false},
+		{[]string{"$0", "$1"}, []string{"id-0", "id-1"}, false},
+		{[]string{"$0.name", "$_.NAME"}, []string{"first", "second"}, false},
+		{[]string{"$0.parentID"}, []string{"30d5ac86"}, false},
+		{[]string{"$_.address"}, []string{""}, false},
+		{[]string{"$NOPE"}, nil, true},
+		{[]string{"$2"}, nil, true},
+		{[]string{"$_.nosuchattribute"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := expand(tt.args)
+		if (err != nil) != tt.wanterr {
+			t.Errorf("expand(%q): error %v, want error: %v", tt.args, err, tt.wanterr)
+			continue
+		}
+		if !tt.wanterr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expand(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	// A variable holding a result buffer reference is expanded in turn
+	vars["LAST"] = "$_.name"
+	if got, err := expand([]string{"$LAST"}); err != nil || got[0] != "second" {
+		t.Errorf("expand($LAST) = %q, %v, want [second]", got, err)
+	}
+
+	results = nil
+	if _, err := expand([]string{"$_"}); err == nil {
+		t.Errorf("expand($_) with an empty result buffer: no error")
+	}
+}
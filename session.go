@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abiosoft/ishell"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+)
+
+// Nuage API session upkeep: Transparent re-authentication when the session API key has expired -- retrying the failed API
+// call, in the transport chain (see "transport.go") -- and an optional background keep-alive.
+
+// With keep-alive on, re-authenticate ahead of time if the API key expires within this many keep-alive intervals
+const keepaliveahead = 2
+
+var (
+	// Serializes shell commands with the keep-alive
+	sessionlock sync.Mutex
+
+	// Serializes re-authentications by the transport, and guards the API key
+	reauthlock sync.Mutex
+
+	// API key of the session and its expiry (ms since the epoch), as returned by the last GET /me, and the headers of
+	// the login -- repeated to re-authenticate. bambou and "root" keep the API key of the first login: The transport
+	// replaces it with the current one (see "reauthenticating"), so that re-authenticating writes to nothing bambou reads
+	apikey        string
+	apikeyexpires int64
+	loginheader   http.Header
+
+	// Secret the session logs in with: The password -- none with a certificate. Set before the session starts
+	loginsecret string
+
+	// Transport chain without re-authentication, to log in again with
+	logintransport http.RoundTripper
+
+	keepaliveinterval time.Duration
+	keepalivestop     chan struct{}
+)
+
+// Whether an error returned by a Nuage API call is due to an invalid / expired API key
+func unauthorized(err error) bool {
+	be, ok := err.(*bambou.Error)
+	return ok && be != nil && be.Code == http.StatusUnauthorized
+}
+
+// Record the API key returned by a GET /me. Call with reauthlock held
+func readapikey(data []byte) bool {
+	var me []struct {
+		APIKey       string
+		APIKeyExpiry int64
+	}
+	if json.Unmarshal(data, &me) != nil || len(me) == 0 || me[0].APIKey == "" {
+		return false
+	}
+	apikey, apikeyexpires = me[0].APIKey, me[0].APIKeyExpiry
+	return true
+}
+
+// Re-authenticate the current session: Log in again as the session did. Call with reauthlock held
+func reauth() error {
+	if loginheader == nil || logintransport == nil {
+		return errors.New("No login to repeat")
+	}
+
+	req, err := http.NewRequest("GET", connurl+"/me", nil)
+	if err != nil {
+		return err
+	}
+	req.Header = loginheader.Clone()
+
+	resp, err := logintransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	data := readbody(&resp.Body, maxerrorbody)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("Authentication failed (HTTP %d): Check the user, password / certificate and organization", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("Login failed: %s", resp.Status)
+	case !readapikey(data):
+		return errors.New("Login failed: No API key in the VSD reply")
+	}
+	return nil
+}
+
+// Re-authenticate, serialized with the transport
+func relogin() error {
+	reauthlock.Lock()
+	defer reauthlock.Unlock()
+
+	return reauth()
+}
+
+// Expiry time of the session API key. Zero if unknown
+func apikeyexpiry() time.Time {
+	reauthlock.Lock()
+	defer reauthlock.Unlock()
+
+	if apikeyexpires == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, apikeyexpires*int64(time.Millisecond))
+}
+
+// Forget the API key and login of the session
+func forgetlogin() {
+	reauthlock.Lock()
+	defer reauthlock.Unlock()
+
+	apikey, apikeyexpires, loginheader, loginsecret, logintransport = "", 0, nil, "", nil
+}
+
+// Wraps a shell command so that it is serialized with the keep-alive. Expired API keys are dealt with by the transport
+// (see "reauthenticating" below): A command still failing with HTTP 401 means re-authentication failed.
+func withsession(fn ishell.CmdFunc) ishell.CmdFunc {
+	return func(args ...string) (string, error) {
+		// Commands run from aliases / "foreach" loops hold the lock already
+		if depth == 0 {
+			sessionlock.Lock()
+			defer sessionlock.Unlock()
+		}
+
+		out, err := fn(args...)
+		if root == nil || !unauthorized(err) {
+			return out, err
+		}
+
+		resetconn()
+		return "Re-authentication failed. Please re-establish the connection using `makeconn` or `makecertconn` ", err
+	}
+}
+
+// Whether an API call is the login itself
+func islogin(req *http.Request) bool {
+	return strings.HasSuffix(strings.TrimRight(req.URL.Path, "/"), "/me")
+}
+
+// Scheme, user and API key (or password) an API call was made with: "Authorization: XREST <base64 of user:key>" -- or
+// "Basic"
+func credentials(req *http.Request) (string, string, string, bool) {
+	auth := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(auth) != 2 || (!strings.EqualFold(auth[0], "XREST") && !strings.EqualFold(auth[0], "Basic")) {
+		return "", "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[1])
+	if err != nil {
+		return "", "", "", false
+	}
+	creds := strings.SplitN(string(b), ":", 2)
+	if len(creds) != 2 {
+		return "", "", "", false
+	}
+	return auth[0], creds[0], creds[1], true
+}
+
+// Copy of an API call, made with another API key
+func withkey(req *http.Request, scheme, user, key string) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	r.Header.Set("Authorization", scheme+" "+base64.StdEncoding.EncodeToString([]byte(user+":"+key)))
+	return r, nil
+}
+
+// Make API calls with the current API key, and record the API key returned by GET /me. Re-authenticate when an API call
+// fails because the API key has expired, then retry that API call -- and only that one, so that the rest of what the
+// command did is not repeated -- with the new API key. Concurrent API calls failing alike re-authenticate only once, and
+// API calls made meanwhile wait for the new API key.
+func reauthenticating(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		scheme, user, used, ok := credentials(req)
+
+		// Logins go as they are
+		if islogin(req) && (!ok || used == loginsecret) {
+			resp, err := next.RoundTrip(req)
+			if err == nil && resp.StatusCode == http.StatusOK {
+				data := readbody(&resp.Body, maxerrorbody)
+
+				reauthlock.Lock()
+				if readapikey(data) {
+					loginheader = req.Header.Clone()
+				}
+				reauthlock.Unlock()
+			}
+			return resp, err
+		}
+
+		reauthlock.Lock()
+		key := apikey
+		reauthlock.Unlock()
+
+		if !ok || key == "" {
+			return next.RoundTrip(req)
+		}
+
+		r := req
+		if key != used {
+			var err error
+			if r, err = withkey(req, scheme, user, key); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := next.RoundTrip(r)
+		if err == nil && resp.StatusCode == http.StatusOK && islogin(req) {
+			data := readbody(&resp.Body, maxerrorbody)
+
+			reauthlock.Lock()
+			readapikey(data)
+			reauthlock.Unlock()
+		}
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		reauthlock.Lock()
+		if apikey == key {
+			fmt.Println("\nNuage API session expired -- re-authenticating")
+			if rerr := reauth(); rerr != nil {
+				reauthlock.Unlock()
+				log.WithField("session", sessionname()).Warnf("Nuage API re-authentication failed: %s", rerr)
+				return resp, err
+			}
+		}
+		key = apikey
+		reauthlock.Unlock()
+
+		retry, rerr := withkey(req, scheme, user, key)
+		if rerr != nil {
+			return resp, err
+		}
+
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxerrorbody))
+		resp.Body.Close()
+
+		return next.RoundTrip(retry)
+	})
+}
+
+func keepalive(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		sessionlock.Lock()
+
+		if root != nil {
+			var err error
+
+			// An expired API key is dealt with by the transport
+			if time.Until(apikeyexpiry()) < keepaliveahead*interval {
+				err = relogin()
+			} else if ferr := root.Fetch(); ferr != nil {
+				err = ferr
+			}
+
+			if err != nil {
+				log.WithField("session", sessionname()).Warnf("Nuage API session keep-alive failed: %s", err)
+			}
+		}
+
+		sessionlock.Unlock()
+	}
+}
+
+func stopkeepalive() {
+	if keepalivestop != nil {
+		close(keepalivestop)
+		keepalivestop = nil
+	}
+	keepaliveinterval = 0
+}
+
+// Set / display the keep-alive interval
+func setkeepalive(args ...string) (string, error) {
+	switch len(args) {
+	case 0:
+		if keepaliveinterval == 0 {
+			return "Keep-alive is off", nil
+		}
+		return "Keep-alive every " + keepaliveinterval.String(), nil
+	case 1:
+		if args[0] == "off" {
+			stopkeepalive()
+			return "Keep-alive is off", nil
+		}
+
+		minutes, err := strconv.Atoi(args[0])
+		if err != nil || minutes < 1 {
+			break
+		}
+
+		stopkeepalive()
+		keepaliveinterval = time.Duration(minutes) * time.Minute
+		keepalivestop = make(chan struct{})
+		go keepalive(keepaliveinterval, keepalivestop)
+
+		return "Keep-alive every " + keepaliveinterval.String(), nil
+	}
+	return "Format: keepalive [ <minutes> | off ]", nil
+}
+
+// API key details, for "displayconn"
+func apikeysummary() string {
+	expiry := apikeyexpiry()
+	if expiry.IsZero() {
+		return "    API key expires: [Unknown]\n"
+	}
+
+	s := fmt.Sprintf("    API key expires: [%s] (in %s)\n", expiry.Format(time.RFC3339), time.Until(expiry).Truncate(time.Second))
+
+	if keepaliveinterval != 0 {
+		s += fmt.Sprintf("    Keep-alive every %s\n", keepaliveinterval)
+	}
+	return s
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+)
+
+// TLS settings for the Nuage API connection. They apply to both "makeconn" and "makecertconn".
+
+var (
+	tlsca         string // CA bundle (PEM) used to verify the VSD certificate. Empty: System CAs
+	tlsinsecure   bool   // Skip verification of the VSD certificate chain and hostname. Handy for lab VSDs with self-signed certificates
+	tlsservername string // Server name (SNI) to send and to verify the VSD certificate against. Empty: Host part of the VSD URL
+	tlspin        string // SHA-256 fingerprint (hex) the VSD certificate must match -- checked even with "tlsinsecure"
+	tlsroots      *x509.CertPool
+)
+
+// Error returned when the VSD certificate does not match "tlspin"
+var errpin = errors.New("x509: VSD certificate does not match the pinned fingerprint")
+
+// Normalize a SHA-256 fingerprint: Lower case hex, no separators
+func fingerprint(s string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "", "-", "").Replace(s))
+}
+
+func certfingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// The TLS client configuration for the current settings, on top of "base" (e.g. with the client certificate)
+func tlsconfig(base *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+
+	cfg.InsecureSkipVerify = tlsinsecure
+	cfg.ServerName = tlsservername
+	cfg.RootCAs = tlsroots
+	cfg.VerifyPeerCertificate = nil
+
+	if pin := tlspin; pin != "" {
+		cfg.VerifyPeerCertificate = func(rawcerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawcerts) == 0 || certfingerprint(rawcerts[0]) != pin {
+				return errpin
+			}
+			return nil
+		}
+	}
+	return cfg
+}
+
+// HTTP transport to the VSD, with the TLS settings -- and the client certificate of "makecertconn", if any
+func basetransport(cert *tls.Certificate) *http.Transport {
+	base := &tls.Config{}
+	if cert != nil {
+		base.Certificates = []tls.Certificate{*cert}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsconfig(base)
+	tr.MaxIdleConnsPerHost = fetchworkers
+	return tr
+}
+
+// Tell certificate verification failures apart from authentication failures when a connection fails to start. bambou
+// only keeps the text of the error: Look at the error returned by the HTTP transport instead (see "transport.go").
+func connerror(err *bambou.Error) error {
+	failurelock.Lock()
+	cause := lasttransporterror
+	failurelock.Unlock()
+
+	var (
+		unknownca x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		noroots   x509.SystemRootsError
+	)
+
+	switch {
+	case errors.Is(cause, errpin):
+		return fmt.Errorf("TLS certificate verification failed: VSD certificate does not match the pinned fingerprint [%s]. Use `tls showcert` to display the VSD certificate", tlspin)
+	case errors.As(cause, &unknownca) || errors.As(cause, &hostname) || errors.As(cause, &invalid) || errors.As(cause, &noroots):
+		return fmt.Errorf("TLS certificate verification failed: %s\n    Use `tls ca <file>` and / or `tls servername <name>` -- or, for lab VSDs only, `tls insecure on`", cause)
+	case err.Code == http.StatusUnauthorized || err.Code == http.StatusForbidden:
+		return fmt.Errorf("Authentication failed (HTTP %d): Check the user, password / certificate and organization. %s", err.Code, err)
+	}
+	return err
+}
+
+// One line summary of the TLS settings
+func tlssummary() string {
+	var s []string
+
+	if tlsinsecure {
+		s = append(s, "certificate NOT verified")
+	} else if tlsca != "" {
+		s = append(s, "verified against CA bundle ["+tlsca+"]")
+	} else {
+		s = append(s, "verified against system CAs")
+	}
+	if tlsservername != "" {
+		s = append(s, "server name ["+tlsservername+"]")
+	}
+	if tlspin != "" {
+		s = append(s, "pinned to SHA-256 fingerprint ["+tlspin+"]")
+	}
+	return strings.Join(s, ", ")
+}
+
+func loadca(fname string) error {
+	pem, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No PEM certificates found in [%s]", fname)
+	}
+
+	tlsca, tlsroots = fname, pool
+	return nil
+}
+
+// Connect to the VSD and display its certificate, verified or not -- e.g. to find out what fingerprint to pin
+func showcert() (string, error) {
+	u, err := url.Parse(vsdurl)
+	if err != nil || u.Host == "" {
+		return "Invalid VSD url. Please set connection details using `setconn` command ", nil
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "443")
+	}
+
+	cfg := tlsconfig(nil)
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyPeerCertificate = nil
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	for i, cert := range conn.ConnectionState().PeerCertificates {
+		fmt.Printf("\n ===> Certificate nr [%d] <===\n    Subject: [%s]\n    Issuer: [%s]\n    Valid: [%s] to [%s]\n    DNS names: %v\n    SHA-256 fingerprint: [%s]\n",
+			i, cert.Subject, cert.Issuer, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339), cert.DNSNames, certfingerprint(cert.Raw))
+	}
+
+	// Now check it against the current settings
+	cfg = tlsconfig(nil)
+	if tlsinsecure {
+		return "\nVSD certificate chain not verified (`tls insecure on`)", nil
+	}
+	vconn, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return "\nVSD certificate does NOT verify with the current TLS settings: " + err.Error(), nil
+	}
+	vconn.Close()
+
+	return "\nVSD certificate verifies with the current TLS settings", nil
+}
+
+// Set / display the TLS settings
+func settls(args ...string) (string, error) {
+	const format = "Format: tls [ ca <file> | ca none | insecure on | insecure off | servername <name> | servername none | pin <SHA-256 fingerprint> | pin none | showcert ]"
+
+	if len(args) == 0 {
+		return "TLS: " + tlssummary(), nil
+	}
+
+	if args[0] == "showcert" && len(args) == 1 {
+		return showcert()
+	}
+
+	if len(args) != 2 {
+		return format, nil
+	}
+
+	switch args[0] {
+	case "ca":
+		if args[1] == "none" {
+			tlsca, tlsroots = "", nil
+			break
+		}
+		if err := loadca(args[1]); err != nil {
+			return "", err
+		}
+		// A CA bundle is only of use if certificates are verified
+		tlsinsecure = false
+	case "insecure":
+		switch args[1] {
+		case "on":
+			tlsinsecure = true
+		case "off":
+			tlsinsecure = false
+		default:
+			return format, nil
+		}
+	case "servername":
+		tlsservername = args[1]
+		if tlsservername == "none" {
+			tlsservername = ""
+		}
+	case "pin":
+		tlspin = fingerprint(args[1])
+		if tlspin == "none" {
+			tlspin = ""
+		} else if _, err := hex.DecodeString(tlspin); err != nil || len(tlspin) != 2*sha256.Size {
+			tlspin = ""
+			return "Invalid SHA-256 fingerprint: " + args[1], nil
+		}
+	default:
+		return format, nil
+	}
+
+	return "TLS: " + tlssummary() + ". Takes effect at the next `makeconn` / `makecertconn`", nil
+}
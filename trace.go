@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP tracing of every Nuage API call: Method, URL, headers, request body, status, latency and response body, plus a
+// curl command line reproducing the call outside the shell. Credentials -- passwords, API keys -- are redacted.
+
+// Largest request / response body traced
+const maxtracebody = 16 << 20
+
+var (
+	tracing   bool
+	tracefile *os.File
+
+	tracelock  sync.Mutex
+	tracecalls uint64
+
+	// "password": "...", "APIKey": "..." in JSON bodies
+	secretattr = regexp.MustCompile(`("(?:[A-Za-z]*[Pp]assword|APIKey)"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+)
+
+func traceout() io.Writer {
+	if tracefile != nil {
+		return tracefile
+	}
+	return os.Stdout
+}
+
+func redactheader(name string, values []string) string {
+	if strings.EqualFold(name, "Authorization") {
+		return "<redacted>"
+	}
+	return strings.Join(values, ", ")
+}
+
+func redactbody(body []byte) string {
+	return secretattr.ReplaceAllString(string(body), `$1"<redacted>"`)
+}
+
+func traceheaders(w io.Writer, prefix string, h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%s%s: %s\n", prefix, name, redactheader(name, h[name]))
+	}
+}
+
+// Quote a string for a POSIX shell
+func shellquote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// curl command line equivalent to an API call. The Authorization header is taken from $NUAGE_AUTH
+func curlcommand(req *http.Request, body []byte) string {
+	cmd := []string{"curl"}
+	if tlsinsecure {
+		cmd = append(cmd, "-k")
+	}
+	cmd = append(cmd, "-X", req.Method, shellquote(req.URL.String()))
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if strings.EqualFold(name, "Authorization") {
+			cmd = append(cmd, "-H", `"Authorization: $NUAGE_AUTH"`)
+			continue
+		}
+		for _, v := range req.Header[name] {
+			cmd = append(cmd, "-H", shellquote(name+": "+v))
+		}
+	}
+
+	if len(body) > 0 {
+		cmd = append(cmd, "--data-binary", shellquote(redactbody(body)))
+	}
+	return strings.Join(cmd, " ")
+}
+
+// Trace every API call while "tracing" is on. API calls are numbered, to match responses to requests when several
+// calls are in flight
+func tracer(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		if !tracing {
+			return next.RoundTrip(req)
+		}
+
+		n := atomic.AddUint64(&tracecalls, 1)
+
+		var reqbody []byte
+		if req.GetBody != nil {
+			if body, err := req.GetBody(); err == nil {
+				reqbody = readbody(&body, maxtracebody)
+			}
+		}
+
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "\n>>>>>>>> #%d %s %s %s\n", n, time.Now().Format(time.RFC3339Nano), req.Method, req.URL)
+		traceheaders(&b, ">> ", req.Header)
+		if len(reqbody) > 0 {
+			fmt.Fprintf(&b, ">>\n%s\n", redactbody(reqbody))
+		}
+		fmt.Fprintf(&b, ">> curl: %s\n", curlcommand(req, reqbody))
+		tracewrite(b.Bytes())
+
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+		latency := time.Since(start)
+
+		b.Reset()
+		if err != nil {
+			fmt.Fprintf(&b, "<<<<<<<< #%d %s after %s\n", n, err, latency)
+			tracewrite(b.Bytes())
+			return resp, err
+		}
+
+		fmt.Fprintf(&b, "<<<<<<<< #%d %s (%s)\n", n, resp.Status, latency)
+		traceheaders(&b, "<< ", resp.Header)
+		if body, complete := peekbody(&resp.Body, maxtracebody); len(body) > 0 {
+			fmt.Fprintf(&b, "<<\n%s\n", redactbody(body))
+			if !complete {
+				fmt.Fprintf(&b, "<< [Truncated at %d bytes]\n", maxtracebody)
+			}
+		}
+		tracewrite(b.Bytes())
+
+		return resp, err
+	})
+}
+
+func tracewrite(data []byte) {
+	tracelock.Lock()
+	traceout().Write(data)
+	tracelock.Unlock()
+}
+
+func closetracefile() {
+	if tracefile != nil {
+		tracefile.Close()
+		tracefile = nil
+	}
+}
+
+// Turn tracing on (optionally to a file) / off
+func settrace(args ...string) (string, error) {
+	switch {
+	case len(args) == 0:
+	case args[0] == "on" && len(args) <= 2:
+		closetracefile()
+		if len(args) == 2 {
+			f, err := os.OpenFile(args[1], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return "", err
+			}
+			tracefile = f
+		}
+		tracing = true
+	case args[0] == "off" && len(args) == 1:
+		closetracefile()
+		tracing = false
+	default:
+		return "Format: trace [ on [ <file> ] | off ]", nil
+	}
+
+	switch {
+	case !tracing:
+		return "HTTP tracing is off", nil
+	case tracefile != nil:
+		return "HTTP tracing is on, to " + tracefile.Name(), nil
+	}
+	return "HTTP tracing is on", nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		{`{"name": "web"}`, `{"name": "web"}`},
+		{`{"password": "s3cret"}`, `{"password": "<redacted>"}`},
+		{`{"password":"s3cret","name":"x"}`, `{"password":"<redacted>","name":"x"}`},
+		{`{"newPassword": "a", "oldPassword" : "b"}`, `{"newPassword": "<redacted>", "oldPassword" : "<redacted>"}`},
+		{`{"password": "with \"quotes\" and \\ backslash", "name": "x"}`, `{"password": "<redacted>", "name": "x"}`},
+		{`{"password": ""}`, `{"password": "<redacted>"}`},
+		{`[{"APIKey": "02a0a0ef-5cf4-4b9a-a1a2-2b5e0b1c3d4e", "APIKeyExpiry": 1500000000000, "userName": "csproot"}]`,
+			`[{"APIKey": "<redacted>", "APIKeyExpiry": 1500000000000, "userName": "csproot"}]`},
+		{`{"APIKey":"k","enterpriseID":"e"}`, `{"APIKey":"<redacted>","enterpriseID":"e"}`},
+		// Not secrets
+		{`{"description": "password policy", "passwordHint": "x"}`, `{"description": "password policy", "passwordHint": "x"}`},
+		{`{"APIKeyExpiry": 1500000000000}`, `{"APIKeyExpiry": 1500000000000}`},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := redactbody([]byte(tt.body)); got != tt.want {
+			t.Errorf("redactbody(%s) = %s, want %s", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRedactHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{"Authorization", []string{"XREST Y3Nwcm9vdDpjc3Byb290"}, "<redacted>"},
+		{"authorization", []string{"XREST Y3Nwcm9vdDpjc3Byb290"}, "<redacted>"},
+		{"X-Nuage-Organization", []string{"csp"}, "csp"},
+		{"Accept", []string{"application/json", "text/plain"}, "application/json, text/plain"},
+	}
+
+	for _, tt := range tests {
+		if got := redactheader(tt.name, tt.values); got != tt.want {
+			t.Errorf("redactheader(%s, %q) = %q, want %q", tt.name, tt.values, got, tt.want)
+		}
+	}
+}
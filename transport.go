@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+)
+
+// Transport chain of the Nuage API connection: http.RoundTrippers wrapped around the HTTP transport to the VSD, to
+// observe and act upon every API call the bambou session makes.
+
+// Largest response body kept for error reporting
+const maxerrorbody = 1 << 20
+
+type roundtripper func(*http.Request) (*http.Response, error)
+
+func (f roundtripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Last failed API call: Request and response, as far as they matter for error reporting
+type failure struct {
+	Method      string
+	URL         string
+	RequestBody []byte
+	Status      int
+	StatusText  string
+	Body        []byte
+}
+
+var (
+	failurelock sync.Mutex
+	lastfailure *failure
+
+	// Last error returned by the HTTP transport -- e.g. a certificate verification failure -- since the session started
+	lasttransporterror error
+
+	// Transport chain of the connection, and the Nuage API URL it connects to
+	apitransport http.RoundTripper
+	connurl      string
+)
+
+// Route the API calls of a session through the transport chain, before starting it: The session is pointed at a relay
+// (see "relay.go") passing them on to the VSD, over the HTTP transport with the TLS settings -- and the client
+// certificate, if any
+func applytransport(s *bambou.Session, cert *tls.Certificate) error {
+	failurelock.Lock()
+	lasttransporterror = nil
+	failurelock.Unlock()
+
+	var base http.RoundTripper = basetransport(cert)
+	if replaying != nil {
+		base = replaying
+	}
+
+	chain := retrying(tracer(recorder(caching(throttle(base)))))
+	apitransport = contextual(capturefailures(auditing(reauthenticating(chain))))
+
+	reauthlock.Lock()
+	logintransport = contextual(capturefailures(chain))
+	reauthlock.Unlock()
+
+	r, err := startrelay(vsdurl, apitransport)
+	if err != nil {
+		return err
+	}
+	apirelay = r
+
+	connurl = vsdurl + apiprefix + apiversion
+	s.URL = r.url + apiprefix + apiversion
+	return nil
+}
+
+// Read (and replace) a request or response body, so it can be read again: Up to max bytes are returned -- e.g. for the
+// trace -- but the body is left whole
+func readbody(body *io.ReadCloser, max int64) []byte {
+	data, _ := peekbody(body, max)
+	return data
+}
+
+// Read up to max bytes of a body, as readbody, and tell whether that is all of it
+func peekbody(body *io.ReadCloser, max int64) ([]byte, bool) {
+	if *body == nil {
+		return nil, true
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(*body, max+1))
+	if err == nil && int64(len(data)) <= max {
+		(*body).Close()
+		*body = ioutil.NopCloser(bytes.NewReader(data))
+		return data, true
+	}
+
+	// The rest is read from the body as it is
+	rest := *body
+	*body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(data), rest), rest}
+
+	if int64(len(data)) > max {
+		data = data[:max]
+	}
+	return data, false
+}
+
+// Response to a request made up by the shell -- e.g. replayed or cached
+func newresponse(req *http.Request, status int, header http.Header, body []byte) *http.Response {
+	h := http.Header{}
+	for name, values := range header {
+		h[name] = values
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// Keep the request and response of API calls that fail, for error reporting
+func capturefailures(next http.RoundTripper) http.RoundTripper {
+	return roundtripper(func(req *http.Request) (*http.Response, error) {
+		var reqbody []byte
+		if req.GetBody != nil {
+			if body, err := req.GetBody(); err == nil {
+				reqbody = readbody(&body, maxerrorbody)
+			}
+		}
+
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			failurelock.Lock()
+			lasttransporterror = err
+			failurelock.Unlock()
+			return resp, err
+		}
+		if resp.StatusCode < 400 {
+			return resp, err
+		}
+
+		f := &failure{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			RequestBody: reqbody,
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			Body:        readbody(&resp.Body, maxerrorbody),
+		}
+
+		failurelock.Lock()
+		lastfailure = f
+		failurelock.Unlock()
+
+		return resp, err
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPeekBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		max      int64
+		want     string
+		complete bool
+	}{
+		{"", 4, "", true},
+		{"abc", 4, "abc", true},
+		{"abcd", 4, "abcd", true},
+		{"abcdefgh", 4, "abcd", false},
+	}
+
+	for _, tt := range tests {
+		var body io.ReadCloser = ioutil.NopCloser(strings.NewReader(tt.body))
+		got, complete := peekbody(&body, tt.max)
+		if string(got) != tt.want || complete != tt.complete {
+			t.Errorf("peekbody(%q, %d) = %q, %v, want %q, %v", tt.body, tt.max, got, complete, tt.want, tt.complete)
+		}
+
+		// The body is left whole
+		if rest, _ := ioutil.ReadAll(body); string(rest) != tt.body {
+			t.Errorf("peekbody(%q, %d): Body left %q", tt.body, tt.max, rest)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/FlorianOtel/vspk-go/vspk"
+)
+
+// UNDO for the last DELETE: The deleted object (and optionally its subtree) is fetched and stashed before being deleted,
+// so it can be re-created later under its original parent. VSD assigns new IDs to re-created objects. The stash is kept
+// until all of it is re-created: UNDO again retries what failed, and skips what was re-created already.
+
+type stash struct {
+	entity   string
+	obj      vsdobject
+	children []*stash
+
+	// Original ID, and ID once re-created
+	id, newid string
+}
+
+// Outcome of an UNDO: Old to new IDs, the number of objects re-created -- not counting those already there -- and
+// whether any could not be
+type undone struct {
+	ids     map[string]string
+	created int
+	failed  bool
+}
+
+// Objects stashed by the last successful DELETE
+var lastdeleted *stash
+
+// Fetch the subtree of "obj" into "s", children on the worker pool. Errors fetching children are reported but otherwise
+// ignored -- the subtree is then stashed only partially. Returns an error only if cancelled.
+func (s *stash) fetchchildren(ctx context.Context) error {
+	var (
+		kids   []*stash
+		failed *bambou.Error
+	)
+
+	add := func(entity string, obj vsdobject) {
+		kids = append(kids, &stash{entity: entity, obj: obj})
+	}
+
+	switch o := s.obj.(type) {
+	case *vspk.Enterprise:
+		if dtl, err := o.DomainTemplates(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, dt := range dtl {
+				add("domaintemplate", dt)
+			}
+		}
+		if dl, err := o.Domains(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, d := range dl {
+				add("domain", d)
+			}
+		}
+		if ltl, err := o.L2DomainTemplates(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, lt := range ltl {
+				add("l2domaintemplate", lt)
+			}
+		}
+		if l2l, err := o.L2Domains(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, l2 := range l2l {
+				add("l2domain", l2)
+			}
+		}
+	case *vspk.L2Domain:
+		if vpl, err := o.VPorts(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, vp := range vpl {
+				add("vport", vp)
+			}
+		}
+	case *vspk.DomainTemplate:
+		if ztl, err := o.ZoneTemplates(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, zt := range ztl {
+				add("zonetemplate", zt)
+			}
+		}
+	case *vspk.Domain:
+		if zl, err := o.Zones(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, z := range zl {
+				add("zone", z)
+			}
+		}
+	case *vspk.Zone:
+		if sl, err := o.Subnets(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, sn := range sl {
+				add("subnet", sn)
+			}
+		}
+	case *vspk.Subnet:
+		if vpl, err := o.VPorts(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, vp := range vpl {
+				add("vport", vp)
+			}
+		}
+	case *vspk.VPort:
+		// Interfaces are re-created under their VM / container, attached to the re-created vport
+		if il, err := o.VMInterfaces(&bambou.FetchingInfo{}); err != nil {
+			failed = err
+		} else {
+			for _, intf := range il {
+				add("vminterface", intf)
+			}
+		}
+		if unsupported("DELETE", "containerinterfaces") == "" {
+			if il, err := o.ContainerInterfaces(&bambou.FetchingInfo{}); err != nil {
+				failed = err
+			} else {
+				for _, intf := range il {
+					add("containerinterface", intf)
+				}
+			}
+		}
+	}
+
+	if failed != nil {
+		fmt.Printf("Warning: Fetching the subtree of %s ID [%s] failed, UNDO will only partially re-create it: %s\n", s.entity, objid(s.obj), failed)
+	}
+
+	s.children = kids
+
+	return fanout(ctx, len(kids), func(ctx context.Context, i int) error {
+		return kids[i].fetchchildren(ctx)
+	})
+}
+
+// Re-create the stashed object under the parent with ID "parentid", then its subtree. Old to new IDs are recorded in "u".
+func (s *stash) recreate(parentid string, u *undone) {
+	if s.id == "" {
+		s.id = objid(s.obj)
+	}
+	oldid := s.id
+
+	// Re-created by a previous UNDO
+	if s.newid != "" {
+		u.ids[oldid] = s.newid
+		for _, kid := range s.children {
+			kid.recreate(s.newid, u)
+		}
+		return
+	}
+
+	// Zones and subnets may already be there, instantiated from the template of a re-created domain / zone -- and
+	// interfaces, if VSD did not delete them with their vport
+	if id, ferr := s.existing(parentid); ferr != nil {
+		u.failed = true
+		fmt.Printf("Not re-creating %s ID [%s]: Cannot check for an existing one: %s\n", s.entity, oldid, ferr)
+		return
+	} else if id != "" {
+		s.newid, u.ids[oldid] = id, id
+		fmt.Printf("  %-16s [%s] ===> [%s] (already there)\n", s.entity, oldid, id)
+		for _, kid := range s.children {
+			kid.recreate(id, u)
+		}
+		return
+	}
+
+	// References to re-created objects, e.g. the template of a domain
+	remap(s.obj, u.ids)
+
+	rec, aerr := newaudit("UNDO", []string{s.entity, oldid}, s.entity, oldid)
+	if aerr != nil {
+		u.failed = true
+		fmt.Printf("Not re-creating %s ID [%s]: %s\n", s.entity, oldid, aerr)
+		return
+	}
+
+	var err *bambou.Error
+
+	switch o := s.obj.(type) {
+	case *vspk.Enterprise:
+		o.ID = ""
+		err = root.CreateEnterprise(o)
+	case *vspk.DomainTemplate:
+		parent := new(vspk.Enterprise)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateDomainTemplate(o)
+	case *vspk.ZoneTemplate:
+		parent := new(vspk.DomainTemplate)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateZoneTemplate(o)
+	case *vspk.Domain:
+		parent := new(vspk.Enterprise)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateDomain(o)
+	case *vspk.L2DomainTemplate:
+		parent := new(vspk.Enterprise)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateL2DomainTemplate(o)
+	case *vspk.L2Domain:
+		parent := new(vspk.Enterprise)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateL2Domain(o)
+	case *vspk.Zone:
+		parent := new(vspk.Domain)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateZone(o)
+	case *vspk.Subnet:
+		parent := new(vspk.Zone)
+		parent.ID = parentid
+		o.ID, o.ParentID = "", parentid
+		err = parent.CreateSubnet(o)
+	case *vspk.VPort:
+		o.ID, o.ParentID = "", parentid
+		if o.ParentType == "l2domain" {
+			parent := new(vspk.L2Domain)
+			parent.ID = parentid
+			err = parent.CreateVPort(o)
+		} else {
+			parent := new(vspk.Subnet)
+			parent.ID = parentid
+			err = parent.CreateVPort(o)
+		}
+	case *vspk.VMInterface:
+		// Under its VM, even when stashed with its vport
+		parent := new(vspk.VM)
+		parent.ID = o.ParentID
+		o.ID = ""
+		err = parent.CreateVMInterface(o)
+	case *vspk.ContainerInterface:
+		parent := new(vspk.Container)
+		parent.ID = o.ParentID
+		o.ID = ""
+		err = parent.CreateContainerInterface(o)
+	case *vspk.VM:
+		o.ID = ""
+		err = root.CreateVM(o)
+	case *vspk.Container:
+		o.ID = ""
+		err = root.CreateContainer(o)
+	default:
+		u.failed = true
+		rec.done(fmt.Errorf("Don't know how to re-create %s", s.entity))
+		fmt.Printf("Don't know how to re-create %s ID [%s]\n", s.entity, oldid)
+		return
+	}
+
+	if err != nil {
+		u.failed = true
+		rec.done(err)
+		fmt.Printf("Skipping the subtree of %s ID [%s]. %s\n", s.entity, oldid, newvsderror("Re-creating "+s.entity+" ID ["+oldid+"]", err, lastfailure))
+		return
+	}
+
+	s.newid = objid(s.obj)
+	u.ids[oldid] = s.newid
+	u.created++
+
+	rec.ID = s.newid
+	rec.after(s.obj)
+	rec.done(nil)
+
+	fmt.Printf("  %-16s [%s] ===> [%s]\n", s.entity, oldid, s.newid)
+
+	for _, kid := range s.children {
+		kid.recreate(s.newid, u)
+	}
+}
+
+// ID of the object of the same name as the stashed zone / subnet under the parent with ID "parentid", or of the stashed
+// interface, if any
+func (s *stash) existing(parentid string) (string, *bambou.Error) {
+	switch o := s.obj.(type) {
+	case *vspk.VMInterface, *vspk.ContainerInterface:
+		obj := newobject(s.entity, s.id)
+		switch err := obj.Fetch(); {
+		case err == nil:
+			return s.id, nil
+		case notfound(err):
+			return "", nil
+		default:
+			return "", err
+		}
+	case *vspk.Zone:
+		parent := new(vspk.Domain)
+		parent.ID = parentid
+		zl, err := parent.Zones(&bambou.FetchingInfo{Filter: fmt.Sprintf("name == %q", o.Name)})
+		if err != nil || len(zl) == 0 {
+			return "", err
+		}
+		return zl[0].ID, nil
+	case *vspk.Subnet:
+		parent := new(vspk.Zone)
+		parent.ID = parentid
+		sl, err := parent.Subnets(&bambou.FetchingInfo{Filter: fmt.Sprintf("name == %q", o.Name)})
+		if err != nil || len(sl) == 0 {
+			return "", err
+		}
+		return sl[0].ID, nil
+	}
+	return "", nil
+}
+
+// Replace the IDs of re-created objects found in the ID attributes of "obj" -- other than its own ID and parent ID -- by
+// their new IDs: Template IDs, vport IDs of interfaces ...
+func remap(obj vsdobject, ids map[string]string) {
+	var attrs map[string]interface{}
+
+	b, _ := json.Marshal(obj)
+	if err := json.Unmarshal(b, &attrs); err != nil {
+		return
+	}
+
+	changed := make(map[string]interface{})
+	for k, v := range attrs {
+		if strings.EqualFold(k, "ID") || strings.EqualFold(k, "parentID") {
+			continue
+		}
+		if nv, ok := remapvalue(k, v, ids); ok {
+			changed[k] = nv
+		}
+	}
+
+	if len(changed) > 0 {
+		b, _ = json.Marshal(changed)
+		json.Unmarshal(b, obj)
+	}
+}
+
+// Remap the value of attribute "k": An "...ID" / "...IDs" attribute, or a list / object that may hold some
+func remapvalue(k string, v interface{}, ids map[string]string) (interface{}, bool) {
+	switch val := v.(type) {
+	case string:
+		lk := strings.ToLower(k)
+		if nid, ok := ids[val]; ok && (strings.HasSuffix(lk, "id") || strings.HasSuffix(lk, "ids")) {
+			return nid, true
+		}
+	case []interface{}:
+		changed := false
+		for i := range val {
+			if nv, ok := remapvalue(k, val[i], ids); ok {
+				val[i], changed = nv, true
+			}
+		}
+		return val, changed
+	case map[string]interface{}:
+		changed := false
+		for mk := range val {
+			if nv, ok := remapvalue(mk, val[mk], ids); ok {
+				val[mk], changed = nv, true
+			}
+		}
+		return val, changed
+	}
+	return v, false
+}
+
+// ID of a VSD object, as known to the shell
+func objid(obj vsdobject) string {
+	s, _ := attribute(obj, "ID")
+	return s
+}
+
+// ID of the parent of a VSD object
+func objparentid(obj vsdobject) string {
+	s, _ := attribute(obj, "parentID")
+	return s
+}
+
+// Re-create the objects deleted by the last DELETE
+func Undo(args ...string) (string, error) {
+	if root == nil {
+		return "Not Connected", nil
+	}
+
+	if lastdeleted == nil {
+		return "Nothing to UNDO", nil
+	}
+
+	s := lastdeleted
+	if s.id == "" {
+		s.id = objid(s.obj)
+	}
+	u := &undone{ids: make(map[string]string)}
+
+	fmt.Printf("Re-creating %s ID [%s]. Old ID ===> New ID:\n", s.entity, s.id)
+	s.recreate(objparentid(s.obj), u)
+
+	// Keep the stash for another UNDO to retry what failed
+	if u.failed {
+		return fmt.Sprintf("UNDO -- %d object(s) restored, some could not be. Run UNDO again to retry them", u.created), nil
+	}
+
+	lastdeleted = nil
+	return fmt.Sprintf("UNDO -- done, %d object(s) restored", u.created), nil
+}
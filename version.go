@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abiosoft/ishell"
+)
+
+// Nuage API version handling.
+//
+// The API version is an attribute of the connection: It is set by "setconn" (or a profile) and used by "makeconn" /
+// "makecertconn". The entity registry below records the first API version of the entities the shell commands operate on --
+// only containers are newer than v3_0 -- so that commands not supported by the connected VSD are refused with a clear
+// message: Every API wrapper command goes through it ("withversion"), commands that only visit some entity types along the
+// way (e.g. FIND, LINT) skip those. There is no attribute-level knowledge: Attributes are those of "vspkversion".
+
+// Nuage API version vspk-go was generated for. Attributes added in later API versions are not known to the shell.
+const vspkversion = "v4_0"
+
+// Entities (by their REST name) and the first Nuage API version that has them
+var entities = map[string]string{
+	"enterprises":              "v3_0",
+	"domaintemplates":          "v3_0",
+	"zonetemplates":            "v3_0",
+	"domains":                  "v3_0",
+	"l2domains":                "v3_0",
+	"l2domaintemplates":        "v3_0",
+	"zones":                    "v3_0",
+	"subnets":                  "v3_0",
+	"vports":                   "v3_0",
+	"vms":                      "v3_0",
+	"vminterfaces":             "v3_0",
+	"hostinterfaces":           "v3_0",
+	"bridgeinterfaces":         "v3_0",
+	"ipreservations":           "v3_0",
+	"addressranges":            "v3_0",
+	"policygroups":             "v3_0",
+	"ingressacltemplates":      "v3_0",
+	"ingressaclentrytemplates": "v3_0",
+	"egressacltemplates":       "v3_0",
+	"egressaclentrytemplates":  "v3_0",
+	"containers":               "v4_0",
+	"containerinterfaces":      "v4_0",
+}
+
+var (
+	// API version of the current connection
+	connversion string
+
+	// API versions reported by the VSD at connection time: The current one, and all supported ones
+	servercurrent  string
+	serverversions []string
+)
+
+// Split an API version of the form "v5_0" or "v6" into its major and minor numbers
+func versionnumbers(v string) (int, int) {
+	parts := strings.SplitN(strings.TrimPrefix(strings.ToLower(v), "v"), "_", 2)
+
+	major, _ := strconv.Atoi(parts[0])
+	minor := 0
+	if len(parts) == 2 {
+		minor, _ = strconv.Atoi(parts[1])
+	}
+	return major, minor
+}
+
+// Whether API version "v" is the same as, or later than, API version "since"
+func versionatleast(v, since string) bool {
+	vmaj, vmin := versionnumbers(v)
+	smaj, smin := versionnumbers(since)
+	return vmaj > smaj || (vmaj == smaj && vmin >= smin)
+}
+
+// Singular entity names used by the shell commands (e.g. "DELETE vm <ID>") to REST names
+func restname(entity string) string {
+	name := strings.ToLower(entity)
+	if _, ok := entities[name]; ok {
+		return name
+	}
+	if _, ok := entities[name+"s"]; ok {
+		return name + "s"
+	}
+	return name
+}
+
+// Check that the connected VSD supports all the entities a command operates on. Returns a message saying why not, or "".
+func unsupported(command string, names ...string) string {
+	if connversion == "" {
+		return ""
+	}
+
+	for _, name := range names {
+		since, ok := entities[restname(name)]
+		if ok && !versionatleast(connversion, since) {
+			return fmt.Sprintf("%s %s: Not supported by Nuage API %s -- requires Nuage API %s or later", command, name, connversion, since)
+		}
+	}
+	return ""
+}
+
+// Wraps an API wrapper command -- named in upper case, e.g. "GET" -- so that it is refused before any API call is made
+// if an entity it is given (e.g. "GET enterprises <ID> containers") is not supported by the connected VSD
+func withversion(name string, fn ishell.CmdFunc) ishell.CmdFunc {
+	if strings.ToUpper(name) != name {
+		return fn
+	}
+	return func(args ...string) (string, error) {
+		if msg := unsupported(name, args...); msg != "" {
+			return msg, nil
+		}
+		return fn(args...)
+	}
+}
+
+// Fetch the API versions supported by the VSD: GET <vsdurl>/nuage
+func fetchserverversions() error {
+	c := &http.Client{Transport: apitransport}
+
+	resp, err := c.Get(apirelay.upstream + "/nuage")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s/nuage: %s", apirelay.upstream, resp.Status)
+	}
+
+	var reply struct {
+		Versions []struct {
+			Version string `json:"version"`
+			Status  string `json:"status"`
+		} `json:"versions"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("GET %s/nuage: %s", apirelay.upstream, err)
+	}
+
+	servercurrent, serverversions = "", nil
+	for _, v := range reply.Versions {
+		// Reported as e.g. "v5.0"
+		version, err := parseapiversion(v.Version)
+		if err != nil {
+			continue
+		}
+		serverversions = append(serverversions, version)
+		if v.Status == "CURRENT" {
+			servercurrent = version
+		}
+	}
+	return nil
+}
+
+// Record the API version of a new connection and what the VSD reports. Returns warnings to be displayed, if any
+func checkversions() string {
+	connversion = apiversion
+
+	if err := fetchserverversions(); err != nil {
+		return "Warning: Cannot obtain the API versions supported by the VSD: " + err.Error()
+	}
+
+	var warnings []string
+
+	found := false
+	for _, v := range serverversions {
+		found = found || v == connversion
+	}
+	if !found && len(serverversions) > 0 {
+		warnings = append(warnings, fmt.Sprintf("Warning: VSD does not list Nuage API %s as supported. Supported: %s", connversion, strings.Join(serverversions, ", ")))
+	}
+
+	if !versionatleast(vspkversion, connversion) {
+		warnings = append(warnings, fmt.Sprintf("Warning: The shell was built for Nuage API %s. Attributes added in Nuage API %s are not displayed", vspkversion, connversion))
+	}
+
+	return strings.Join(warnings, "\n")
+}
+
+// API version details, for "displayconn"
+func versionsummary() string {
+	s := fmt.Sprintf("    Nuage API version: [%s]\n", connversion)
+
+	if servercurrent != "" || len(serverversions) > 0 {
+		s += fmt.Sprintf("    VSD reported API versions: Current [%s], supported [%s]\n", servercurrent, strings.Join(serverversions, ", "))
+	} else {
+		s += "    VSD reported API versions: Unknown\n"
+	}
+	return s
+}
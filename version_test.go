@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithVersion(t *testing.T) {
+	saved := connversion
+	t.Cleanup(func() { connversion = saved })
+
+	called := false
+	get := withversion("GET", func(args ...string) (string, error) {
+		called = true
+		return "", nil
+	})
+	set := withversion("set", func(args ...string) (string, error) {
+		called = true
+		return "", nil
+	})
+
+	tests := []struct {
+		version string
+		fn      func(...string) (string, error)
+		args    []string
+		refused bool
+	}{
+		{"v3_2", get, []string{"enterprises"}, false},
+		{"v3_2", get, []string{"containers"}, true},
+		{"v3_2", get, []string{"enterprises", "e1", "containers"}, true},
+		{"v3_2", get, []string{"container", "c1"}, true},
+		{"v4_0", get, []string{"enterprises", "e1", "containers"}, false},
+		{"v5_0", get, []string{"containerinterfaces"}, false},
+		{"", get, []string{"containers"}, false},
+		{"v3_2", set, []string{"containers"}, false},
+	}
+
+	for _, tt := range tests {
+		connversion, called = tt.version, false
+		msg, _ := tt.fn(tt.args...)
+		refused := strings.Contains(msg, "Not supported")
+		if refused != tt.refused || called == tt.refused {
+			t.Errorf("%s %v: Refused %v (%q), want %v", tt.version, tt.args, refused, msg, tt.refused)
+		}
+	}
+}